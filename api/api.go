@@ -1,11 +1,68 @@
 package api
 
+import "math"
+
+// staleNaNBits is the NaN Prometheus writes to mark a series as stale, its
+// payload sets it apart from NaN values exposed by targets
+const staleNaNBits = 0x7ff0000000000002
+
+// StaleNaN ends a series, queries ignore the series from the timestamp of the
+// marker on until it receives a new sample
+var StaleNaN = math.Float64frombits(staleNaNBits)
+
+// IsStaleNaN reports whether the value is a staleness marker, NaN values are
+// not equal to each other so the bits have to be compared
+func IsStaleNaN(value float64) bool {
+	return math.Float64bits(value) == staleNaNBits
+}
+
+type MetricType string
+
+const (
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+	MetricTypeUntyped   MetricType = "untyped"
+
+	// types only known to OpenMetrics
+	MetricTypeGaugeHistogram MetricType = "gaugehistogram"
+	MetricTypeInfo           MetricType = "info"
+	MetricTypeStateSet       MetricType = "stateset"
+	MetricTypeUnknown        MetricType = "unknown"
+)
+
 type Label struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 }
 
+// Exemplar references a sample outside the metric set, e.g. a trace
+type Exemplar struct {
+	Labels    []Label `json:"labels"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+}
+
 type Sample struct {
 	Labels []Label `json:"labels"`
 	Value  float64 `json:"value"`
+	// Timestamp in milliseconds since the epoch, nil if the exposition did
+	// not carry one
+	Timestamp *int64    `json:"timestamp,omitempty"`
+	Exemplar  *Exemplar `json:"exemplar,omitempty"`
+}
+
+// Timestamp returns a timestamp in milliseconds for samples, histograms and
+// summaries
+func Timestamp(ms int64) *int64 {
+	return &ms
+}
+
+// Metadata describes a metric family as announced by the HELP and TYPE lines
+type Metadata struct {
+	Name string     `json:"name"`
+	Type MetricType `json:"type"`
+	Help string     `json:"help"`
+	Unit string     `json:"unit,omitempty"`
 }
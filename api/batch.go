@@ -0,0 +1,23 @@
+package api
+
+// Batch carries the samples and families of a single scrape to the store,
+// which writes them in one transaction. The store reads Samples and Families
+// until Commit receives the outcome of the scrape: true commits the
+// transaction, false rolls it back. Done is closed once the transaction is
+// finished. The channels are unbuffered, so everything sent before the outcome
+// has been read by the store.
+type Batch struct {
+	Samples  chan Sample
+	Families chan Family
+	Commit   chan bool
+	Done     chan bool
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		Samples:  make(chan Sample),
+		Families: make(chan Family),
+		Commit:   make(chan bool),
+		Done:     make(chan bool),
+	}
+}
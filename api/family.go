@@ -0,0 +1,146 @@
+package api
+
+import (
+	"math"
+	"strconv"
+)
+
+type Bucket struct {
+	UpperBound float64 `json:"upperBound"`
+	Count      float64 `json:"count"`
+}
+
+// Histogram is a classic histogram assembled from its _bucket, _sum and _count
+// series, the labels include the family name but not the le label
+type Histogram struct {
+	Labels    []Label  `json:"labels"`
+	Buckets   []Bucket `json:"buckets"`
+	Sum       float64  `json:"sum"`
+	Count     float64  `json:"count"`
+	Timestamp *int64   `json:"timestamp,omitempty"`
+	// Created is the value of the OpenMetrics _created series, zero if absent
+	Created float64 `json:"created,omitempty"`
+}
+
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Summary is assembled from its quantile, _sum and _count series, the labels
+// include the family name but not the quantile label
+type Summary struct {
+	Labels    []Label    `json:"labels"`
+	Quantiles []Quantile `json:"quantiles"`
+	Sum       float64    `json:"sum"`
+	Count     float64    `json:"count"`
+	Timestamp *int64     `json:"timestamp,omitempty"`
+	// Created is the value of the OpenMetrics _created series, zero if absent
+	Created float64 `json:"created,omitempty"`
+}
+
+// Family is a metric family announced by HELP or TYPE lines, histograms and
+// summaries are grouped into the family while all other samples are passed
+// on individually
+type Family struct {
+	Metadata
+	Histograms []Histogram `json:"histograms,omitempty"`
+	Summaries  []Summary   `json:"summaries,omitempty"`
+}
+
+func FormatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(f, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func created(labels []Label, name string, value float64, timestamp *int64) []Sample {
+	if value == 0 {
+		return nil
+	}
+	return []Sample{{
+		Labels:    withName(labels, name+"_created"),
+		Value:     value,
+		Timestamp: timestamp,
+	}}
+}
+
+func withName(labels []Label, name string, extra ...Label) []Label {
+	result := []Label{{Name: "__name__", Value: name}}
+	for _, label := range labels {
+		if label.Name != "__name__" {
+			result = append(result, label)
+		}
+	}
+	return append(result, extra...)
+}
+
+// Samples flattens the histogram into the series of the text exposition format
+func (h *Histogram) Samples(name string) []Sample {
+	var samples []Sample
+	for _, bucket := range h.Buckets {
+		samples = append(samples, Sample{
+			Labels:    withName(h.Labels, name+"_bucket", Label{Name: "le", Value: FormatFloat(bucket.UpperBound)}),
+			Value:     bucket.Count,
+			Timestamp: h.Timestamp,
+		})
+	}
+	samples = append(samples, Sample{
+		Labels:    withName(h.Labels, name+"_sum"),
+		Value:     h.Sum,
+		Timestamp: h.Timestamp,
+	}, Sample{
+		Labels:    withName(h.Labels, name+"_count"),
+		Value:     h.Count,
+		Timestamp: h.Timestamp,
+	})
+	return append(samples, created(h.Labels, name, h.Created, h.Timestamp)...)
+}
+
+// GaugeSamples flattens a gauge histogram into its _bucket, _gsum and _gcount
+// series, gauge histograms have no _created series
+func (h *Histogram) GaugeSamples(name string) []Sample {
+	var samples []Sample
+	for _, bucket := range h.Buckets {
+		samples = append(samples, Sample{
+			Labels:    withName(h.Labels, name+"_bucket", Label{Name: "le", Value: FormatFloat(bucket.UpperBound)}),
+			Value:     bucket.Count,
+			Timestamp: h.Timestamp,
+		})
+	}
+	return append(samples, Sample{
+		Labels:    withName(h.Labels, name+"_gsum"),
+		Value:     h.Sum,
+		Timestamp: h.Timestamp,
+	}, Sample{
+		Labels:    withName(h.Labels, name+"_gcount"),
+		Value:     h.Count,
+		Timestamp: h.Timestamp,
+	})
+}
+
+// Samples flattens the summary into the series of the text exposition format
+func (s *Summary) Samples(name string) []Sample {
+	var samples []Sample
+	for _, quantile := range s.Quantiles {
+		samples = append(samples, Sample{
+			Labels:    withName(s.Labels, name, Label{Name: "quantile", Value: FormatFloat(quantile.Quantile)}),
+			Value:     quantile.Value,
+			Timestamp: s.Timestamp,
+		})
+	}
+	samples = append(samples, Sample{
+		Labels:    withName(s.Labels, name+"_sum"),
+		Value:     s.Sum,
+		Timestamp: s.Timestamp,
+	}, Sample{
+		Labels:    withName(s.Labels, name+"_count"),
+		Value:     s.Count,
+		Timestamp: s.Timestamp,
+	})
+	return append(samples, created(s.Labels, name, s.Created, s.Timestamp)...)
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"scrape/api"
+	"scrape/pkg/config"
+	"scrape/pkg/discovery"
 	"scrape/pkg/promql"
 	"scrape/pkg/scrape"
+	"scrape/pkg/web"
 	"scrape/store"
 	"scrape/version"
 	"strings"
@@ -18,21 +25,67 @@ import (
 	"time"
 )
 
-func startTicker(tick chan<- bool, duration time.Duration) {
-	go func() {
-		for true {
-			tick <- true
-			time.Sleep(duration)
+// targetsFromFlags creates targets for the urls given on the command line, they
+// all belong to the same job
+func targetsFromFlags(scrapeUrls string, interval time.Duration) ([]*scrape.Target, error) {
+	timeout := time.Duration(config.DefaultScrapeTimeout)
+	if timeout > interval {
+		timeout = interval
+	}
+
+	var targets []*scrape.Target
+	for _, u := range strings.Split(scrapeUrls, ",") {
+		scrapeUrl, err := url.Parse(strings.TrimSpace(u))
+		if err != nil {
+			return nil, err
 		}
-	}()
+		targets = append(targets, &scrape.Target{
+			Job:      "scrape",
+			URL:      scrapeUrl,
+			Interval: interval,
+			Timeout:  timeout,
+		})
+	}
+	return targets, nil
+}
+
+// printResult prints every row of a query result as a series followed by its
+// value and timestamp
+func printResult(result *store.SqliteResult) {
+	if !result.Success {
+		fmt.Println("[error] query failed")
+		return
+	}
+
+	for _, row := range result.Rows {
+		// the last two columns are the value and the timestamp
+		n := len(row.Columns)
+		if n < 2 {
+			continue
+		}
+		var name string
+		var labels []string
+		for _, column := range row.Columns[:n-2] {
+			if column.Name == "__name__" {
+				name = column.Value
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%v=%q", column.Name, column.Value))
+		}
+		fmt.Println(fmt.Sprintf("%v{%v} %v %v", name, strings.Join(labels, ","), row.Columns[n-2].Value, row.Columns[n-1].Value))
+	}
 }
 
 func main() {
 	printVersion := flag.Bool("version", false, "print version and exit")
+	configFile := flag.String("config.file", "", "configuration file, takes precedence over -scrape.urls and -scrape.interval")
 	scrapeUrls := flag.String("scrape.urls", "", "list of urls to scrape")
 	scrapeInterval := flag.String("scrape.interval", "10s", "scrape interval")
 	sqliteFilename := flag.String("sqlite.file", "metrics.db", "sqlite database file")
 	interactive := flag.Bool("interactive", false, "interactive mode")
+	strict := flag.Bool("ingest.strict", true, "fail the whole scrape on the first malformed line, otherwise malformed lines are skipped")
+	listenAddress := flag.String("web.listen-address", "", "address to serve the reload and targets endpoints on, e.g. localhost:9090, empty to disable")
+	enableLifecycle := flag.Bool("web.enable-lifecycle", false, "allow reloading the configuration with POST /-/reload")
 	flag.Parse()
 
 	if *printVersion {
@@ -40,56 +93,129 @@ func main() {
 		os.Exit(0)
 	}
 
-	quitScrape := make(chan bool, 1)
 	quitDb := make(chan bool, 1)
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	samples := make(chan api.Sample, 512)
-	tick := make(chan bool)
-	queries := make(chan promql.PromQlASTElement)
+	batches := make(chan *api.Batch)
+	queries := make(chan store.SqliteQuery)
 	wg := &sync.WaitGroup{}
+	// scrapers are waited for separately, they have to be stopped before the
+	// store
+	scrapersWg := &sync.WaitGroup{}
 
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGABRT, syscall.SIGINT)
-	go func() {
-		sig := <-sigs
-		switch sig {
-		case syscall.SIGTERM, syscall.SIGABRT, syscall.SIGINT:
-			quitScrape <- true
-			quitDb <- true
+	reload := make(chan chan error)
+	// quitWeb is closed on shutdown, reload requests are refused after that
+	quitWeb := make(chan bool)
+	scheduler := scrape.NewScheduler(samples, batches)
+	manager := scrape.NewManager(scheduler, *strict, scrapersWg)
+
+	duration, err := time.ParseDuration(*scrapeInterval)
+	if err != nil {
+		panic(err)
+	}
+
+	// current is the config the targets are created from, nil if the targets
+	// were given on the command line
+	var current *config.Config
+	var targets []*scrape.Target
+	discoveryManager := discovery.NewManager()
+	if *configFile != "" {
+		current, err = config.LoadFile(*configFile)
+		if err != nil {
+			log.Fatalf("[config] %v", err)
 		}
-	}()
+		targets = scrape.TargetsFromConfig(current, nil)
+		discoveryManager.Run(discovery.Discoverers(current))
+	} else if *scrapeUrls != "" {
+		targets, err = targetsFromFlags(*scrapeUrls, duration)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	sqlite, err := store.NewSqliteStore(*sqliteFilename, wg)
 	if err != nil {
 		panic(err)
 	}
 
-	sqlite.Run(samples, quitDb, queries)
+	sqlite.Run(samples, batches, quitDb, queries)
 
-	if scrapeUrls != nil && *scrapeUrls != "" {
-		var scrapeTargets []*url.URL
-		urls := strings.Split(*scrapeUrls, ",")
-		for _, u := range urls {
-			scrapeTarget, err := url.Parse(strings.TrimSpace(u))
-			if err != nil {
-				panic(err)
-			}
-			scrapeTargets = append(scrapeTargets, scrapeTarget)
+	err = manager.Sync(targets)
+	if err != nil {
+		log.Printf("[scrape] not all targets could be started: %v", err)
+	}
+
+	// reloadConfig applies the targets of the config file to the running
+	// scrapers, the store keeps running
+	reloadConfig := func() error {
+		if *configFile == "" {
+			return errors.New("no config file given")
 		}
+		c, err := config.LoadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		current = c
+		discoveryManager.Run(discovery.Discoverers(c))
+		return manager.Sync(scrape.TargetsFromConfig(c, discoveryManager.Groups()))
+	}
 
-		for _, scrapeTarget := range scrapeTargets {
-			scraper, err := scrape.NewUrlScaper(scrapeTarget, wg)
-			if err != nil {
-				panic(err)
-			}
-			scraper.Scrape(samples, quitScrape, tick)
+	// logReload reports the outcome of a reload, the current targets are kept
+	// if it failed
+	logReload := func(err error) {
+		if err != nil {
+			log.Printf("[config] reload failed: %v", err)
+		} else {
+			log.Printf("[config] reloaded %v", *configFile)
 		}
 	}
 
-	duration, err := time.ParseDuration(*scrapeInterval)
-	if err != nil {
-		panic(err)
+	if *listenAddress != "" {
+		listener, err := net.Listen("tcp", *listenAddress)
+		if err != nil {
+			log.Fatalf("[web] %v", err)
+		}
+		go func() {
+			var webReload chan chan error
+			if *enableLifecycle {
+				webReload = reload
+			}
+			err := http.Serve(listener, web.NewWeb(webReload, quitWeb, manager.Targets))
+			log.Printf("[web] %v", err)
+		}()
 	}
-	startTicker(tick, duration)
+
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGABRT, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				switch sig {
+				case syscall.SIGHUP:
+					logReload(reloadConfig())
+				case syscall.SIGTERM, syscall.SIGABRT, syscall.SIGINT:
+					close(quitWeb)
+					discoveryManager.Stop()
+					scheduler.Stop()
+					scrapersWg.Wait()
+					quitDb <- true
+					return
+				}
+			case result := <-reload:
+				err := reloadConfig()
+				logReload(err)
+				result <- err
+			case <-discoveryManager.Changed():
+				if current == nil {
+					continue
+				}
+				err := manager.Sync(scrape.TargetsFromConfig(current, discoveryManager.Groups()))
+				if err != nil {
+					log.Printf("[scrape] not all discovered targets could be started: %v", err)
+				}
+			}
+		}
+	}()
 
 	if *interactive {
 
@@ -109,7 +235,12 @@ func main() {
 					fmt.Println(fmt.Sprintf("[error] %v", err.Error()))
 					continue
 				}
-				queries <- ast
+				result := make(chan *store.SqliteResult, 1)
+				queries <- store.SqliteQuery{
+					Query:  ast,
+					Result: result,
+				}
+				printResult(<-result)
 			}
 		}()
 	}
@@ -1,5 +1,12 @@
 module scrape
 
-require github.com/mattn/go-sqlite3 v1.14.15
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/mattn/go-sqlite3 v1.14.15
+	github.com/prometheus/client_model v0.6.3
+	golang.org/x/net v0.34.0
+	google.golang.org/protobuf v1.36.12
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-go 1.19
+go 1.23
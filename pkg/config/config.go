@@ -0,0 +1,310 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"scrape/pkg/relabel"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultScrapeInterval = Duration(time.Minute)
+	DefaultScrapeTimeout  = Duration(10 * time.Second)
+	// DefaultScrapeRetryBackoff is the wait before the first retry of a
+	// failed scrape
+	DefaultScrapeRetryBackoff = Duration(time.Second)
+	DefaultMetricsPath        = "/metrics"
+	DefaultScheme             = "http"
+)
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Duration is a time.Duration that can be read from YAML strings like 30s or 1m
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return errors.New(fmt.Sprintf("negative duration %v", s))
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// ByteSize is a number of bytes that can be read from YAML strings like 512KB
+// or 10MB, units are powers of 1024
+type ByteSize int64
+
+var (
+	byteSizeRegex = regexp.MustCompile(`^([0-9]+)(B|KB|MB|GB|TB)?$`)
+	byteSizeUnits = map[string]int64{
+		"":   1,
+		"B":  1,
+		"KB": 1 << 10,
+		"MB": 1 << 20,
+		"GB": 1 << 30,
+		"TB": 1 << 40,
+	}
+)
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	match := byteSizeRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return errors.New(fmt.Sprintf("invalid size %q", s))
+	}
+	multiplier := byteSizeUnits[match[2]]
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || size > math.MaxInt64/multiplier {
+		return errors.New(fmt.Sprintf("invalid size %q", s))
+	}
+	*b = ByteSize(size * multiplier)
+	return nil
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return fmt.Sprintf("%vB", int64(b)), nil
+}
+
+type GlobalConfig struct {
+	ScrapeInterval Duration `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  Duration `yaml:"scrape_timeout,omitempty"`
+}
+
+// StaticConfig is a group of host:port targets sharing the same labels
+type StaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// ScrapeConfig describes a job, a set of targets scraped with the same settings
+type ScrapeConfig struct {
+	JobName        string              `yaml:"job_name"`
+	ScrapeInterval Duration            `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  Duration            `yaml:"scrape_timeout,omitempty"`
+	MetricsPath    string              `yaml:"metrics_path,omitempty"`
+	Scheme         string              `yaml:"scheme,omitempty"`
+	Params         map[string][]string `yaml:"params,omitempty"`
+	// HonorLabels keeps exposed labels that conflict with target labels,
+	// otherwise they are renamed with an exported_ prefix
+	HonorLabels         bool                  `yaml:"honor_labels,omitempty"`
+	StaticConfigs       []StaticConfig        `yaml:"static_configs,omitempty"`
+	FileSDConfigs       []*FileSDConfig       `yaml:"file_sd_configs,omitempty"`
+	DNSSDConfigs        []*DNSSDConfig        `yaml:"dns_sd_configs,omitempty"`
+	HTTPSDConfigs       []*HTTPSDConfig       `yaml:"http_sd_configs,omitempty"`
+	KubernetesSDConfigs []*KubernetesSDConfig `yaml:"kubernetes_sd_configs,omitempty"`
+	// RelabelConfigs are applied to the labels of a target before it is
+	// scraped, MetricRelabelConfigs to every scraped sample
+	RelabelConfigs       []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs,omitempty"`
+	// limits of a single scrape after decompression and relabeling, a scrape
+	// exceeding any of them fails, zero means no limit
+	BodySizeLimit         ByteSize `yaml:"body_size_limit,omitempty"`
+	SampleLimit           int      `yaml:"sample_limit,omitempty"`
+	LabelLimit            int      `yaml:"label_limit,omitempty"`
+	LabelNameLengthLimit  int      `yaml:"label_name_length_limit,omitempty"`
+	LabelValueLengthLimit int      `yaml:"label_value_length_limit,omitempty"`
+	// ScrapeRetries is how often a failed scrape is retried within the
+	// interval, the backoff doubles with every retry
+	ScrapeRetries      int      `yaml:"scrape_retries,omitempty"`
+	ScrapeRetryBackoff Duration `yaml:"scrape_retry_backoff,omitempty"`
+
+	HTTPClientConfig `yaml:",inline"`
+}
+
+// Config is modelled on the Prometheus configuration file
+type Config struct {
+	Global        GlobalConfig    `yaml:"global"`
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+}
+
+func (c *Config) validate() error {
+	if c.Global.ScrapeInterval == 0 {
+		c.Global.ScrapeInterval = DefaultScrapeInterval
+	}
+	if c.Global.ScrapeTimeout == 0 {
+		c.Global.ScrapeTimeout = DefaultScrapeTimeout
+		if c.Global.ScrapeTimeout > c.Global.ScrapeInterval {
+			c.Global.ScrapeTimeout = c.Global.ScrapeInterval
+		}
+	}
+	if c.Global.ScrapeTimeout > c.Global.ScrapeInterval {
+		return errors.New(fmt.Sprintf("global: scrape_timeout %v greater than scrape_interval %v", c.Global.ScrapeTimeout, c.Global.ScrapeInterval))
+	}
+
+	jobs := map[string]bool{}
+	for i, sc := range c.ScrapeConfigs {
+		if sc == nil {
+			return errors.New(fmt.Sprintf("scrape_configs[%v]: empty scrape config", i))
+		}
+		if sc.JobName == "" {
+			return errors.New(fmt.Sprintf("scrape_configs[%v]: job_name is required", i))
+		}
+		if jobs[sc.JobName] {
+			return errors.New(fmt.Sprintf("scrape_configs[%v]: duplicate job_name %q", i, sc.JobName))
+		}
+		jobs[sc.JobName] = true
+
+		err := sc.validate(&c.Global)
+		if err != nil {
+			return errors.New(fmt.Sprintf("scrape_configs[%v] (job %q): %v", i, sc.JobName, err))
+		}
+	}
+	return nil
+}
+
+func (sc *ScrapeConfig) validate(global *GlobalConfig) error {
+	if sc.ScrapeInterval == 0 {
+		sc.ScrapeInterval = global.ScrapeInterval
+	}
+	if sc.ScrapeTimeout == 0 {
+		sc.ScrapeTimeout = global.ScrapeTimeout
+		if sc.ScrapeTimeout > sc.ScrapeInterval {
+			sc.ScrapeTimeout = sc.ScrapeInterval
+		}
+	}
+	if sc.ScrapeTimeout > sc.ScrapeInterval {
+		return errors.New(fmt.Sprintf("scrape_timeout %v greater than scrape_interval %v", sc.ScrapeTimeout, sc.ScrapeInterval))
+	}
+
+	if sc.MetricsPath == "" {
+		sc.MetricsPath = DefaultMetricsPath
+	}
+	if !strings.HasPrefix(sc.MetricsPath, "/") {
+		return errors.New(fmt.Sprintf("metrics_path %q must start with /", sc.MetricsPath))
+	}
+
+	if sc.Scheme == "" {
+		sc.Scheme = DefaultScheme
+	}
+	if sc.Scheme != "http" && sc.Scheme != "https" {
+		return errors.New(fmt.Sprintf("unsupported scheme %q, expected http or https", sc.Scheme))
+	}
+
+	for i, static := range sc.StaticConfigs {
+		for _, target := range static.Targets {
+			err := validateTarget(target)
+			if err != nil {
+				return errors.New(fmt.Sprintf("static_configs[%v]: %v", i, err))
+			}
+		}
+		for name := range static.Labels {
+			if !labelNameRegex.MatchString(name) {
+				return errors.New(fmt.Sprintf("static_configs[%v]: invalid label name %q", i, name))
+			}
+		}
+	}
+
+	err := sc.HTTPClientConfig.validate()
+	if err != nil {
+		return err
+	}
+
+	if sc.SampleLimit < 0 || sc.LabelLimit < 0 || sc.LabelNameLengthLimit < 0 || sc.LabelValueLengthLimit < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	if sc.ScrapeRetries < 0 {
+		return errors.New("scrape_retries must not be negative")
+	}
+	if sc.ScrapeRetryBackoff == 0 {
+		sc.ScrapeRetryBackoff = DefaultScrapeRetryBackoff
+	}
+
+	err = sc.validateDiscovery()
+	if err != nil {
+		return err
+	}
+
+	for i, rc := range sc.RelabelConfigs {
+		if rc == nil {
+			return errors.New(fmt.Sprintf("relabel_configs[%v]: empty relabel config", i))
+		}
+		err := rc.Validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("relabel_configs[%v]: %v", i, err))
+		}
+	}
+	for i, rc := range sc.MetricRelabelConfigs {
+		if rc == nil {
+			return errors.New(fmt.Sprintf("metric_relabel_configs[%v]: empty relabel config", i))
+		}
+		err := rc.Validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("metric_relabel_configs[%v]: %v", i, err))
+		}
+	}
+	return nil
+}
+
+// validateTarget checks that a target is a host:port pair without scheme or path
+func validateTarget(target string) error {
+	if strings.Contains(target, "/") {
+		return errors.New(fmt.Sprintf("target %q must be host:port without scheme or path", target))
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || port == "" {
+		return errors.New(fmt.Sprintf("target %q must be host:port", target))
+	}
+	return nil
+}
+
+// Load parses and validates a configuration, unset values are filled in with
+// their defaults
+func Load(data []byte) (*Config, error) {
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(c)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func LoadFile(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Load(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("loading %v: %v", filename, err))
+	}
+	return c, nil
+}
@@ -0,0 +1,310 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Load(t *testing.T) {
+	data := `
+global:
+  scrape_interval: 30s
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["localhost:9100", "10.0.0.1:9100"]
+        labels:
+          env: prod
+  - job_name: app
+    scrape_interval: 5s
+    scrape_timeout: 2s
+    metrics_path: /internal/metrics
+    scheme: https
+    honor_labels: true
+    body_size_limit: 10MB
+    basic_auth:
+      username: scraper
+      password_file: /etc/scrape/password
+    headers:
+      X-Scope-OrgID: team-a
+    tls_config:
+      ca_file: /etc/scrape/ca.pem
+      insecure_skip_verify: true
+    sample_limit: 1000
+    relabel_configs:
+      - source_labels: [__address__]
+        target_label: instance
+    params:
+      format: [prometheus]
+    static_configs:
+      - targets: ["app:8443"]
+`
+	c, err := Load([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.ScrapeConfigs) != 2 {
+		t.Fatalf("unexpected number of scrape configs, wanted 2, got %v", len(c.ScrapeConfigs))
+	}
+
+	node := c.ScrapeConfigs[0]
+	if node.ScrapeInterval != Duration(30*time.Second) || node.ScrapeTimeout != DefaultScrapeTimeout {
+		t.Fatalf("unexpected defaults for node job: %v %v", node.ScrapeInterval, node.ScrapeTimeout)
+	}
+	if node.MetricsPath != DefaultMetricsPath || node.Scheme != DefaultScheme {
+		t.Fatalf("unexpected defaults for node job: %v %v", node.MetricsPath, node.Scheme)
+	}
+	if node.StaticConfigs[0].Labels["env"] != "prod" {
+		t.Fatalf("unexpected labels for node job: %v", node.StaticConfigs[0].Labels)
+	}
+
+	app := c.ScrapeConfigs[1]
+	if app.ScrapeInterval != Duration(5*time.Second) || app.ScrapeTimeout != Duration(2*time.Second) {
+		t.Fatalf("unexpected intervals for app job: %v %v", app.ScrapeInterval, app.ScrapeTimeout)
+	}
+	if node.HonorLabels || !app.HonorLabels {
+		t.Fatalf("unexpected honor_labels: %v %v", node.HonorLabels, app.HonorLabels)
+	}
+	if app.BodySizeLimit != 10*1024*1024 || app.SampleLimit != 1000 {
+		t.Fatalf("unexpected limits for app job: %v %v", app.BodySizeLimit, app.SampleLimit)
+	}
+	if app.BasicAuth == nil || app.BasicAuth.Username != "scraper" || app.BasicAuth.PasswordFile != "/etc/scrape/password" {
+		t.Fatalf("unexpected basic auth for app job: %v", app.BasicAuth)
+	}
+	if app.Headers["X-Scope-OrgID"] != "team-a" || app.TLSConfig.CAFile != "/etc/scrape/ca.pem" || !app.TLSConfig.InsecureSkipVerify {
+		t.Fatalf("unexpected http client config for app job: %+v", app.HTTPClientConfig)
+	}
+	if len(app.RelabelConfigs) != 1 || app.RelabelConfigs[0].Replacement != "$1" {
+		t.Fatalf("unexpected relabel configs for app job: %v", app.RelabelConfigs)
+	}
+	if app.Params["format"][0] != "prometheus" {
+		t.Fatalf("unexpected params for app job: %v", app.Params)
+	}
+}
+
+func Test_LoadInvalid(t *testing.T) {
+	type testcase struct {
+		data      string
+		wantError string
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+scrape_configs:
+  - static_configs:
+      - targets: ["localhost:9100"]
+`,
+			wantError: "job_name is required",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+  - job_name: node
+`,
+			wantError: "duplicate job_name",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    scrape_interval: 5s
+    scrape_timeout: 10s
+`,
+			wantError: "greater than scrape_interval",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    scrape_interval: often
+`,
+			wantError: "invalid duration",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    scheme: ftp
+`,
+			wantError: "unsupported scheme",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    metrics_path: metrics
+`,
+			wantError: "must start with /",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        action: hashmod
+        target_label: shard
+`,
+			wantError: "metric_relabel_configs[0]: modulus is required",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    body_size_limit: 10 megabytes
+`,
+			wantError: "invalid size",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    sample_limit: -1
+`,
+			wantError: "limits must not be negative",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    basic_auth:
+      username: scraper
+    bearer_token: secret
+`,
+			wantError: "at most one of basic_auth, bearer_token and bearer_token_file",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    tls_config:
+      cert_file: client.pem
+`,
+			wantError: "requires both cert_file and key_file",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    proxy_url: proxy:3128
+`,
+			wantError: "invalid proxy_url",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    file_sd_configs:
+      - files: [targets.txt]
+`,
+			wantError: "file_sd_configs[0]: file \"targets.txt\" must have a .json, .yml or .yaml extension",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    dns_sd_configs:
+      - names: [nodes.example.com]
+        type: A
+`,
+			wantError: "dns_sd_configs[0]: a valid port is required for A records",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    dns_sd_configs:
+      - names: [example.com]
+        type: MX
+`,
+			wantError: "unsupported record type",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    http_sd_configs:
+      - url: inventory:8080/targets
+`,
+			wantError: "http_sd_configs[0]: invalid url",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    scrape_retries: -1
+`,
+			wantError: "scrape_retries must not be negative",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: pods
+    kubernetes_sd_configs:
+      - role: deployment
+`,
+			wantError: "kubernetes_sd_configs[0]: unsupported role",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: pods
+    kubernetes_sd_configs:
+      - role: pod
+        bearer_token: secret
+`,
+			wantError: "kubernetes_sd_configs[0]: api_server is required",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["http://localhost:9100/metrics"]
+`,
+			wantError: "without scheme or path",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["localhost"]
+`,
+			wantError: "must be host:port",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["localhost:9100"]
+        labels:
+          1env: prod
+`,
+			wantError: "invalid label name",
+		},
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    scrape_intervall: 5s
+`,
+			wantError: "field scrape_intervall not found",
+		},
+	}
+
+	for _, tc := range testcases {
+		_, err := Load([]byte(tc.data))
+		if err == nil {
+			t.Fatalf("expected error %v", tc.wantError)
+		}
+		if !strings.Contains(err.Error(), tc.wantError) {
+			t.Fatalf("unexpected error, wanted %v, got %v", tc.wantError, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+const (
+	DefaultFileSDRefreshInterval = Duration(30 * time.Second)
+	DefaultDNSSDRefreshInterval  = Duration(30 * time.Second)
+	DefaultHTTPSDRefreshInterval = Duration(time.Minute)
+)
+
+var kubernetesRoles = map[string]bool{
+	"pod":       true,
+	"service":   true,
+	"endpoints": true,
+	"node":      true,
+}
+
+// FileSDConfig reads targets from JSON or YAML files in the Prometheus file_sd
+// format, the files are polled for changes
+type FileSDConfig struct {
+	Files           []string `yaml:"files"`
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (c *FileSDConfig) validate() error {
+	if len(c.Files) == 0 {
+		return errors.New("file_sd_config requires at least one file")
+	}
+	for _, pattern := range c.Files {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid file pattern %q: %v", pattern, err))
+		}
+		switch filepath.Ext(pattern) {
+		case ".json", ".yml", ".yaml":
+		default:
+			return errors.New(fmt.Sprintf("file %q must have a .json, .yml or .yaml extension", pattern))
+		}
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultFileSDRefreshInterval
+	}
+	return nil
+}
+
+// DNSSDConfig resolves SRV, A or AAAA records periodically, every answer
+// becomes a target
+type DNSSDConfig struct {
+	Names           []string `yaml:"names"`
+	Type            string   `yaml:"type,omitempty"`
+	Port            int      `yaml:"port,omitempty"`
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (c *DNSSDConfig) validate() error {
+	if len(c.Names) == 0 {
+		return errors.New("dns_sd_config requires at least one name")
+	}
+	if c.Type == "" {
+		c.Type = "SRV"
+	}
+	switch c.Type {
+	case "SRV":
+	case "A", "AAAA":
+		if c.Port <= 0 || c.Port > 65535 {
+			return errors.New(fmt.Sprintf("a valid port is required for %v records", c.Type))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported record type %q, expected SRV, A or AAAA", c.Type))
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultDNSSDRefreshInterval
+	}
+	return nil
+}
+
+// HTTPSDConfig polls a URL returning target groups in the Prometheus HTTP SD
+// format
+type HTTPSDConfig struct {
+	URL              string   `yaml:"url"`
+	RefreshInterval  Duration `yaml:"refresh_interval,omitempty"`
+	HTTPClientConfig `yaml:",inline"`
+}
+
+func (c *HTTPSDConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(fmt.Sprintf("invalid url %q", c.URL))
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultHTTPSDRefreshInterval
+	}
+	return c.HTTPClientConfig.validate()
+}
+
+// KubernetesNamespaces limits discovery to a set of namespaces, all namespaces
+// are watched if it is empty
+type KubernetesNamespaces struct {
+	Names []string `yaml:"names,omitempty"`
+}
+
+// KubernetesSDConfig watches the objects of a role in the Kubernetes API. The
+// API server, token and CA of the service account are used when running in a
+// cluster without api_server.
+type KubernetesSDConfig struct {
+	APIServer        string               `yaml:"api_server,omitempty"`
+	Role             string               `yaml:"role"`
+	Namespaces       KubernetesNamespaces `yaml:"namespaces,omitempty"`
+	HTTPClientConfig `yaml:",inline"`
+}
+
+func (c *KubernetesSDConfig) validate() error {
+	if !kubernetesRoles[c.Role] {
+		return errors.New(fmt.Sprintf("unsupported role %q, expected pod, service, endpoints or node", c.Role))
+	}
+	if c.APIServer == "" {
+		if !reflect.DeepEqual(c.HTTPClientConfig, HTTPClientConfig{}) {
+			return errors.New("api_server is required when configuring the http client")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.APIServer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(fmt.Sprintf("invalid api_server %q", c.APIServer))
+	}
+	return c.HTTPClientConfig.validate()
+}
+
+// validateDiscovery checks the service discovery configs of a job
+func (sc *ScrapeConfig) validateDiscovery() error {
+	for i, c := range sc.FileSDConfigs {
+		if c == nil {
+			return errors.New(fmt.Sprintf("file_sd_configs[%v]: empty file_sd_config", i))
+		}
+		err := c.validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("file_sd_configs[%v]: %v", i, err))
+		}
+	}
+	for i, c := range sc.DNSSDConfigs {
+		if c == nil {
+			return errors.New(fmt.Sprintf("dns_sd_configs[%v]: empty dns_sd_config", i))
+		}
+		err := c.validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("dns_sd_configs[%v]: %v", i, err))
+		}
+	}
+	for i, c := range sc.HTTPSDConfigs {
+		if c == nil {
+			return errors.New(fmt.Sprintf("http_sd_configs[%v]: empty http_sd_config", i))
+		}
+		err := c.validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("http_sd_configs[%v]: %v", i, err))
+		}
+	}
+	for i, c := range sc.KubernetesSDConfigs {
+		if c == nil {
+			return errors.New(fmt.Sprintf("kubernetes_sd_configs[%v]: empty kubernetes_sd_config", i))
+		}
+		err := c.validate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("kubernetes_sd_configs[%v]: %v", i, err))
+		}
+	}
+	return nil
+}
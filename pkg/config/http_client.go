@@ -0,0 +1,210 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BasicAuth sends a username and password with every request, the password can
+// be read from a file instead
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// TLSConfig configures how the certificate of a target is verified and the
+// client certificate presented to it
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// HTTPClientConfig configures the client used to scrape the targets of a job or
+// to query a service discovery endpoint
+type HTTPClientConfig struct {
+	BasicAuth *BasicAuth `yaml:"basic_auth,omitempty"`
+	// BearerTokenFile is read again when it changes
+	BearerToken     string            `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string            `yaml:"bearer_token_file,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	TLSConfig       TLSConfig         `yaml:"tls_config,omitempty"`
+	ProxyURL        string            `yaml:"proxy_url,omitempty"`
+}
+
+func (c *HTTPClientConfig) validate() error {
+	if c.BasicAuth != nil {
+		if c.BearerToken != "" || c.BearerTokenFile != "" {
+			return errors.New("at most one of basic_auth, bearer_token and bearer_token_file must be configured")
+		}
+		if c.BasicAuth.Username == "" {
+			return errors.New("basic_auth requires a username")
+		}
+		if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+			return errors.New("at most one of basic_auth password and password_file must be configured")
+		}
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return errors.New("at most one of bearer_token and bearer_token_file must be configured")
+	}
+	for name := range c.Headers {
+		if strings.EqualFold(name, "Authorization") {
+			return errors.New("the Authorization header is set by basic_auth and bearer_token")
+		}
+	}
+	if (c.TLSConfig.CertFile == "") != (c.TLSConfig.KeyFile == "") {
+		return errors.New("tls_config requires both cert_file and key_file")
+	}
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(fmt.Sprintf("invalid proxy_url %q", c.ProxyURL))
+		}
+	}
+	return nil
+}
+
+// fileSecret is a secret read from a file, the file is read again when its
+// modification time changes
+type fileSecret struct {
+	filename string
+	mutex    sync.Mutex
+	modTime  time.Time
+	value    string
+}
+
+func (f *fileSecret) get() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return "", err
+	}
+	if !info.ModTime().Equal(f.modTime) {
+		data, err := os.ReadFile(f.filename)
+		if err != nil {
+			return "", err
+		}
+		f.value = strings.TrimSpace(string(data))
+		f.modTime = info.ModTime()
+	}
+	return f.value, nil
+}
+
+// secret returns a function resolving either the inline value or the content
+// of the file
+func secret(value string, filename string) func() (string, error) {
+	if filename == "" {
+		return func() (string, error) {
+			return value, nil
+		}
+	}
+	f := &fileSecret{filename: filename}
+	return f.get
+}
+
+// authRoundTripper sets the configured headers and credentials on every request
+type authRoundTripper struct {
+	next     http.RoundTripper
+	headers  map[string]string
+	username string
+	password func() (string, error)
+	token    func() (string, error)
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range rt.headers {
+		req.Header.Set(name, value)
+	}
+	if rt.password != nil {
+		password, err := rt.password()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("reading basic auth password: %v", err))
+		}
+		req.SetBasicAuth(rt.username, password)
+	}
+	if rt.token != nil {
+		token, err := rt.token()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("reading bearer token: %v", err))
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return rt.next.RoundTrip(req)
+}
+
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("reading ca_file: %v", err))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in ca_file %v", c.CAFile))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("loading client certificate: %v", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NewHTTPClient creates a client from the config, timeouts are left to the
+// requests
+func NewHTTPClient(c HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	rt := &authRoundTripper{
+		next:    transport,
+		headers: c.Headers,
+	}
+	if c.BasicAuth != nil {
+		rt.username = c.BasicAuth.Username
+		rt.password = secret(c.BasicAuth.Password, c.BasicAuth.PasswordFile)
+	}
+	if c.BearerToken != "" || c.BearerTokenFile != "" {
+		rt.token = secret(c.BearerToken, c.BearerTokenFile)
+	}
+
+	return &http.Client{
+		Transport: rt,
+	}, nil
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	filename := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// serverCA writes the certificate of a TLS test server to a file
+func serverCA(t *testing.T, server *httptest.Server) string {
+	return writeFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}))
+}
+
+// clientCertificate creates a self-signed client certificate and returns the
+// certificate and key files along with the certificate
+func clientCertificate(t *testing.T) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scrape"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := writeFile(t, "client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile := writeFile(t, "client-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	return certFile, keyFile, cert
+}
+
+func Test_HTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		switch {
+		case ok && username == "scraper" && password == "secret":
+		case r.Header.Get("Authorization") == "Bearer token":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Scope-OrgID") != "team-a" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	ca := serverCA(t, server)
+	password := writeFile(t, "password", []byte("secret\n"))
+	headers := map[string]string{"X-Scope-OrgID": "team-a"}
+
+	type testcase struct {
+		name       string
+		config     HTTPClientConfig
+		wantError  bool
+		wantStatus int
+	}
+
+	testcases := []testcase{
+		{
+			name:      "unknown certificate authority",
+			config:    HTTPClientConfig{BearerToken: "token", Headers: headers},
+			wantError: true,
+		},
+		{
+			name: "ca file",
+			config: HTTPClientConfig{
+				BearerToken: "token",
+				Headers:     headers,
+				TLSConfig:   TLSConfig{CAFile: ca},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "insecure skip verify",
+			config: HTTPClientConfig{
+				BearerToken: "token",
+				Headers:     headers,
+				TLSConfig:   TLSConfig{InsecureSkipVerify: true},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "server name covered by the certificate",
+			config: HTTPClientConfig{
+				BearerToken: "token",
+				Headers:     headers,
+				TLSConfig:   TLSConfig{CAFile: ca, ServerName: "example.com"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "server name not covered by the certificate",
+			config: HTTPClientConfig{
+				BearerToken: "token",
+				Headers:     headers,
+				TLSConfig:   TLSConfig{CAFile: ca, ServerName: "scrape.example.org"},
+			},
+			wantError: true,
+		},
+		{
+			name: "basic auth with password file",
+			config: HTTPClientConfig{
+				BasicAuth: &BasicAuth{Username: "scraper", PasswordFile: password},
+				Headers:   headers,
+				TLSConfig: TLSConfig{CAFile: ca},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "wrong basic auth password",
+			config: HTTPClientConfig{
+				BasicAuth: &BasicAuth{Username: "scraper", Password: "guess"},
+				Headers:   headers,
+				TLSConfig: TLSConfig{CAFile: ca},
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "missing header",
+			config: HTTPClientConfig{
+				BearerToken: "token",
+				TLSConfig:   TLSConfig{CAFile: ca},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		client, err := NewHTTPClient(tc.config)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.name, err)
+		}
+
+		resp, err := client.Get(server.URL)
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("%v: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Fatalf("%v: unexpected status, wanted %v, got %v", tc.name, tc.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func Test_HTTPClientBearerTokenFile(t *testing.T) {
+	var got string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	token := writeFile(t, "token", []byte("first\n"))
+	client, err := NewHTTPClient(HTTPClientConfig{
+		BearerTokenFile: token,
+		TLSConfig:       TLSConfig{CAFile: serverCA(t, server)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		err = os.WriteFile(token, []byte(want), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// make sure the change is visible even on coarse file system clocks
+		err = os.Chtimes(token, time.Now(), time.Now().Add(time.Duration(len(want))*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got != "Bearer "+want {
+			t.Fatalf("unexpected authorization header, wanted %v, got %v", "Bearer "+want, got)
+		}
+	}
+}
+
+func Test_HTTPClientCertificate(t *testing.T) {
+	certFile, keyFile, cert := clientCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up 1\n"))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+	ca := serverCA(t, server)
+
+	type testcase struct {
+		tlsConfig TLSConfig
+		wantError bool
+	}
+
+	testcases := []testcase{
+		{
+			tlsConfig: TLSConfig{CAFile: ca},
+			wantError: true,
+		},
+		{
+			tlsConfig: TLSConfig{CAFile: ca, CertFile: certFile, KeyFile: keyFile},
+		},
+	}
+
+	for _, tc := range testcases {
+		client, err := NewHTTPClient(HTTPClientConfig{TLSConfig: tc.tlsConfig})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp, err := client.Get(server.URL)
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error without client certificate")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func Test_HTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("up 1\n"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://exporter.invalid:9100/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if proxied != "http://exporter.invalid:9100/metrics" {
+		t.Fatalf("request was not sent through the proxy, got %v", proxied)
+	}
+}
+
+func Test_HTTPClientInvalid(t *testing.T) {
+	type testcase struct {
+		config HTTPClientConfig
+	}
+
+	testcases := []testcase{
+		{config: HTTPClientConfig{TLSConfig: TLSConfig{CAFile: "/nonexistent/ca.pem"}}},
+		{config: HTTPClientConfig{TLSConfig: TLSConfig{CAFile: writeFile(t, "ca.pem", []byte("not a certificate"))}}},
+		{config: HTTPClientConfig{TLSConfig: TLSConfig{CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}}},
+	}
+
+	for _, tc := range testcases {
+		_, err := NewHTTPClient(tc.config)
+		if err == nil {
+			t.Fatalf("expected error for %+v", tc.config)
+		}
+	}
+}
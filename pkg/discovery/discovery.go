@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"log"
+	"net"
+	"scrape/pkg/config"
+	"sort"
+	"sync"
+)
+
+// Group is a set of targets sharing the same labels. Every target is a label
+// set with at least an __address__ label, the labels of the group apply to all
+// targets that do not set them themselves.
+type Group struct {
+	// Source identifies the group within its discoverer, an update replaces
+	// the group with the same source and an empty group removes it
+	Source  string
+	Targets []map[string]string
+	Labels  map[string]string
+}
+
+// Discoverer sends the groups it finds on the updates channel until quit is
+// closed. The first update contains all groups, even if there are none, later
+// updates only need to contain the groups that changed. Sending must not block
+// once quit is closed.
+type Discoverer interface {
+	Run(updates chan<- []*Group, quit <-chan bool)
+}
+
+// Discoverers creates the discoverers configured for every job
+func Discoverers(c *config.Config) map[string][]Discoverer {
+	discoverers := map[string][]Discoverer{}
+	for _, sc := range c.ScrapeConfigs {
+		for _, fc := range sc.FileSDConfigs {
+			discoverers[sc.JobName] = append(discoverers[sc.JobName], NewFileDiscoverer(fc))
+		}
+		for _, dc := range sc.DNSSDConfigs {
+			discoverers[sc.JobName] = append(discoverers[sc.JobName], NewDNSDiscoverer(dc, net.DefaultResolver))
+		}
+		for _, hc := range sc.HTTPSDConfigs {
+			d, err := NewHTTPDiscoverer(hc)
+			if err != nil {
+				log.Printf("[discovery] job %v: skipping %v: %v", sc.JobName, hc.URL, err)
+				continue
+			}
+			discoverers[sc.JobName] = append(discoverers[sc.JobName], d)
+		}
+		for _, kc := range sc.KubernetesSDConfigs {
+			d, err := NewKubernetesDiscoverer(kc)
+			if err != nil {
+				log.Printf("[discovery] job %v: skipping %v role: %v", sc.JobName, kc.Role, err)
+				continue
+			}
+			discoverers[sc.JobName] = append(discoverers[sc.JobName], d)
+		}
+	}
+	return discoverers
+}
+
+// Manager runs the discoverers of all jobs and keeps the latest groups of every
+// discoverer
+type Manager struct {
+	mutex sync.Mutex
+	// groups by job, position of the discoverer within the job and source
+	groups  map[string]map[int]map[string]*Group
+	quit    chan bool
+	changed chan bool
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		groups:  map[string]map[int]map[string]*Group{},
+		changed: make(chan bool, 1),
+	}
+}
+
+// Changed receives a value whenever the groups of a job have changed, multiple
+// changes may be reported at once
+func (m *Manager) Changed() <-chan bool {
+	return m.changed
+}
+
+// Groups returns the current groups of every job
+func (m *Manager) Groups() map[string][]*Group {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := map[string][]*Group{}
+	for job, discoverers := range m.groups {
+		var indexes []int
+		for index := range discoverers {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			var sources []string
+			for source := range discoverers[index] {
+				sources = append(sources, source)
+			}
+			sort.Strings(sources)
+			for _, source := range sources {
+				result[job] = append(result[job], discoverers[index][source])
+			}
+		}
+	}
+	return result
+}
+
+// Run stops the running discoverers and starts the given ones. The groups of a
+// previous discoverer are kept until the discoverer at the same position of the
+// same job sends its first update, so reloading does not drop targets
+// in between.
+func (m *Manager) Run(discoverers map[string][]Discoverer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.quit != nil {
+		close(m.quit)
+	}
+	m.quit = make(chan bool)
+
+	for job, groups := range m.groups {
+		for index := range groups {
+			if index >= len(discoverers[job]) {
+				delete(groups, index)
+			}
+		}
+		if len(groups) == 0 {
+			delete(m.groups, job)
+		}
+	}
+	m.notify()
+
+	for job, jobDiscoverers := range discoverers {
+		for i, discoverer := range jobDiscoverers {
+			updates := make(chan []*Group)
+			go discoverer.Run(updates, m.quit)
+			go m.receive(job, i, updates, m.quit)
+		}
+	}
+}
+
+// Stop stops all discoverers
+func (m *Manager) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.quit != nil {
+		close(m.quit)
+		m.quit = nil
+	}
+}
+
+// receive stores the updates of a single discoverer until quit is closed
+func (m *Manager) receive(job string, index int, updates <-chan []*Group, quit <-chan bool) {
+	first := true
+	for {
+		select {
+		case <-quit:
+			return
+		case groups := <-updates:
+			m.update(job, index, groups, first, quit)
+			first = false
+		}
+	}
+}
+
+// update stores the groups of a discoverer, the first update replaces all
+// groups of the discoverer
+func (m *Manager) update(job string, index int, groups []*Group, first bool, quit <-chan bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// updates from discoverers that were stopped in the meantime are dropped
+	select {
+	case <-quit:
+		return
+	default:
+	}
+
+	if m.groups[job] == nil {
+		m.groups[job] = map[int]map[string]*Group{}
+	}
+	if first || m.groups[job][index] == nil {
+		m.groups[job][index] = map[string]*Group{}
+	}
+	for _, group := range groups {
+		if len(group.Targets) == 0 {
+			delete(m.groups[job][index], group.Source)
+		} else {
+			m.groups[job][index][group.Source] = group
+		}
+	}
+	m.notify()
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.changed <- true:
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"scrape/pkg/config"
+	"testing"
+	"time"
+)
+
+func Test_Manager(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "targets.yml")
+	err := os.WriteFile(filename, []byte("- targets: [a:9100, b:9100]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	defer m.Stop()
+
+	c := &config.FileSDConfig{Files: []string{filepath.Join(dir, "*.yml")}, RefreshInterval: config.Duration(time.Minute)}
+	m.Run(map[string][]Discoverer{
+		"node": {NewFileDiscoverer(c)},
+	})
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-m.Changed():
+		case <-deadline:
+			t.Fatalf("no groups discovered")
+		}
+		groups := m.Groups()
+		if len(groups["node"]) == 1 && len(groups["node"][0].Targets) == 2 {
+			break
+		}
+	}
+
+	// the groups are kept until the new discoverer of the job reports
+	m.Run(map[string][]Discoverer{
+		"node": {NewFileDiscoverer(c)},
+	})
+	if len(m.Groups()["node"]) != 1 {
+		t.Fatalf("unexpected groups after reload: %v", m.Groups())
+	}
+
+	// jobs without discoverers lose their groups
+	m.Run(map[string][]Discoverer{})
+	if len(m.Groups()) != 0 {
+		t.Fatalf("unexpected groups after reload: %v", m.Groups())
+	}
+}
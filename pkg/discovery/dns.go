@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"scrape/pkg/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up DNS records, it is implemented by net.Resolver
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// DNSDiscoverer resolves a list of names periodically, every record becomes a
+// target in the group of its name
+type DNSDiscoverer struct {
+	names    []string
+	qtype    string
+	port     int
+	interval time.Duration
+	resolver Resolver
+}
+
+func NewDNSDiscoverer(c *config.DNSSDConfig, resolver Resolver) *DNSDiscoverer {
+	return &DNSDiscoverer{
+		names:    c.Names,
+		qtype:    c.Type,
+		port:     c.Port,
+		interval: time.Duration(c.RefreshInterval),
+		resolver: resolver,
+	}
+}
+
+func (d *DNSDiscoverer) Run(updates chan<- []*Group, quit <-chan bool) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		var groups []*Group
+		for _, name := range d.names {
+			group, err := d.resolve(name)
+			if err != nil {
+				// the targets resolved last remain until the name resolves again
+				log.Printf("[discovery] resolving %v failed: %v", name, err)
+				continue
+			}
+			groups = append(groups, group)
+		}
+
+		select {
+		case updates <- groups:
+		case <-quit:
+			return
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notFound reports whether the name does not exist, which removes all of its
+// targets
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// resolve looks up the records of a name, a lookup is limited to the refresh
+// interval
+func (d *DNSDiscoverer) resolve(name string) (*Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+
+	group := &Group{
+		Source: name,
+	}
+
+	switch d.qtype {
+	case "SRV":
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if notFound(err) {
+			return group, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			port := strconv.Itoa(int(record.Port))
+			group.Targets = append(group.Targets, map[string]string{
+				"__address__":                  net.JoinHostPort(target, port),
+				"__meta_dns_name":              name,
+				"__meta_dns_srv_record_target": target,
+				"__meta_dns_srv_record_port":   port,
+			})
+		}
+	default:
+		network := "ip4"
+		if d.qtype == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := d.resolver.LookupIP(ctx, network, name)
+		if notFound(err) {
+			return group, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			group.Targets = append(group.Targets, map[string]string{
+				"__address__":     net.JoinHostPort(ip.String(), strconv.Itoa(d.port)),
+				"__meta_dns_name": name,
+			})
+		}
+	}
+	return group, nil
+}
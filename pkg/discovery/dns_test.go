@@ -0,0 +1,237 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"scrape/pkg/config"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers queries from a fixed set of records, all other names do not
+// exist
+type stubDNS struct {
+	conn    net.PacketConn
+	records map[string][]dnsmessage.Resource
+}
+
+func newStubDNS(t *testing.T, records map[string][]dnsmessage.Resource) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubDNS{
+		conn:    conn,
+		records: records,
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return s
+}
+
+func (s *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		err = query.Unpack(buf[:n])
+		if err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+
+		response := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:                 query.ID,
+				Response:           true,
+				Authoritative:      true,
+				RecursionAvailable: true,
+			},
+			Questions: query.Questions,
+		}
+		found := false
+		for _, record := range s.records[strings.ToLower(question.Name.String())] {
+			found = true
+			if record.Header.Type == question.Type {
+				record.Header.Name = question.Name
+				record.Header.Class = dnsmessage.ClassINET
+				response.Answers = append(response.Answers, record)
+			}
+		}
+		if !found {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+// resolver returns a resolver sending all queries to the stub
+func (s *stubDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func srv(target string, port uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeSRV},
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port},
+	}
+}
+
+func a(ip string) dnsmessage.Resource {
+	var addr [4]byte
+	copy(addr[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA},
+		Body:   &dnsmessage.AResource{A: addr},
+	}
+}
+
+func aaaa(ip string) dnsmessage.Resource {
+	var addr [16]byte
+	copy(addr[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA},
+		Body:   &dnsmessage.AAAAResource{AAAA: addr},
+	}
+}
+
+func Test_DNSDiscoverer(t *testing.T) {
+	stub := newStubDNS(t, map[string][]dnsmessage.Resource{
+		"_metrics._tcp.example.test.": {
+			srv("node-1.example.test.", 9100),
+			srv("node-2.example.test.", 9101),
+		},
+		"nodes.example.test.": {
+			a("10.0.0.1"),
+			a("10.0.0.2"),
+			aaaa("fd00::1"),
+		},
+	})
+
+	type testcase struct {
+		config      config.DNSSDConfig
+		name        string
+		wantTargets []map[string]string
+	}
+
+	testcases := []testcase{
+		{
+			config: config.DNSSDConfig{Type: "SRV"},
+			name:   "_metrics._tcp.example.test",
+			wantTargets: []map[string]string{
+				{
+					"__address__":                  "node-1.example.test:9100",
+					"__meta_dns_name":              "_metrics._tcp.example.test",
+					"__meta_dns_srv_record_target": "node-1.example.test",
+					"__meta_dns_srv_record_port":   "9100",
+				},
+				{
+					"__address__":                  "node-2.example.test:9101",
+					"__meta_dns_name":              "_metrics._tcp.example.test",
+					"__meta_dns_srv_record_target": "node-2.example.test",
+					"__meta_dns_srv_record_port":   "9101",
+				},
+			},
+		},
+		{
+			config: config.DNSSDConfig{Type: "A", Port: 9100},
+			name:   "nodes.example.test",
+			wantTargets: []map[string]string{
+				{"__address__": "10.0.0.1:9100", "__meta_dns_name": "nodes.example.test"},
+				{"__address__": "10.0.0.2:9100", "__meta_dns_name": "nodes.example.test"},
+			},
+		},
+		{
+			config: config.DNSSDConfig{Type: "AAAA", Port: 9100},
+			name:   "nodes.example.test",
+			wantTargets: []map[string]string{
+				{"__address__": "[fd00::1]:9100", "__meta_dns_name": "nodes.example.test"},
+			},
+		},
+		{
+			// names that do not exist have no targets
+			config: config.DNSSDConfig{Type: "A", Port: 9100},
+			name:   "missing.example.test",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.config.Names = []string{tc.name}
+		tc.config.RefreshInterval = config.Duration(5 * time.Second)
+		d := NewDNSDiscoverer(&tc.config, stub.resolver())
+
+		group, err := d.resolve(tc.name)
+		if err != nil {
+			t.Fatalf("%v %v: unexpected error: %v", tc.config.Type, tc.name, err)
+		}
+		if group.Source != tc.name {
+			t.Fatalf("unexpected source %v", group.Source)
+		}
+
+		// the order of the answers is up to the resolver
+		if len(group.Targets) != len(tc.wantTargets) {
+			t.Fatalf("%v %v: unexpected targets, wanted %v, got %v", tc.config.Type, tc.name, tc.wantTargets, group.Targets)
+		}
+		for _, want := range tc.wantTargets {
+			found := false
+			for _, got := range group.Targets {
+				if got["__address__"] != want["__address__"] {
+					continue
+				}
+				found = len(got) == len(want)
+				for name, value := range want {
+					found = found && got[name] == value
+				}
+			}
+			if !found {
+				t.Fatalf("%v %v: missing target %v in %v", tc.config.Type, tc.name, want, group.Targets)
+			}
+		}
+	}
+}
+
+func Test_DNSDiscovererRun(t *testing.T) {
+	stub := newStubDNS(t, map[string][]dnsmessage.Resource{
+		"nodes.example.test.": {a("10.0.0.1")},
+	})
+
+	d := NewDNSDiscoverer(&config.DNSSDConfig{
+		Names:           []string{"nodes.example.test", "missing.example.test"},
+		Type:            "A",
+		Port:            9100,
+		RefreshInterval: config.Duration(time.Minute),
+	}, stub.resolver())
+
+	updates := make(chan []*Group)
+	quit := make(chan bool)
+	defer close(quit)
+	go d.Run(updates, quit)
+
+	select {
+	case groups := <-updates:
+		if len(groups) != 2 || len(groups[0].Targets) != 1 || len(groups[1].Targets) != 0 {
+			t.Fatalf("unexpected groups %v", groups)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no update received")
+	}
+}
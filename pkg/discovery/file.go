@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"scrape/pkg/config"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// targetGroup is a target group as written in file_sd files and returned by
+// http_sd endpoints
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// fileState is what is known about a file from the last time it was read
+type fileState struct {
+	modTime time.Time
+	groups  int
+}
+
+// FileDiscoverer polls files for target groups, files are only read again when
+// their modification time changes
+type FileDiscoverer struct {
+	patterns []string
+	interval time.Duration
+	files    map[string]fileState
+}
+
+func NewFileDiscoverer(c *config.FileSDConfig) *FileDiscoverer {
+	return &FileDiscoverer{
+		patterns: c.Files,
+		interval: time.Duration(c.RefreshInterval),
+		files:    map[string]fileState{},
+	}
+}
+
+func (d *FileDiscoverer) Run(updates chan<- []*Group, quit <-chan bool) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	first := true
+	for {
+		groups := d.refresh()
+		if first || len(groups) > 0 {
+			first = false
+			select {
+			case updates <- groups:
+			case <-quit:
+				return
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// source identifies the group of a file or url by its position
+func source(location string, index int) string {
+	return fmt.Sprintf("%v:%v", location, index)
+}
+
+// refresh returns the groups of all files that changed since the last refresh
+// and empty groups for the groups that are gone
+func (d *FileDiscoverer) refresh() []*Group {
+	var changed []*Group
+
+	var filenames []string
+	found := map[string]bool{}
+	for _, pattern := range d.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("[discovery] invalid file pattern %v: %v", pattern, err)
+			continue
+		}
+		for _, filename := range matches {
+			if !found[filename] {
+				found[filename] = true
+				filenames = append(filenames, filename)
+			}
+		}
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			log.Printf("[discovery] reading %v failed: %v", filename, err)
+			continue
+		}
+		state, known := d.files[filename]
+		if known && info.ModTime().Equal(state.modTime) {
+			continue
+		}
+
+		groups, err := readFile(filename)
+		if err != nil {
+			// the groups read last remain until the file is fixed
+			log.Printf("[discovery] reading %v failed: %v", filename, err)
+			continue
+		}
+		changed = append(changed, groups...)
+		for i := len(groups); i < state.groups; i++ {
+			changed = append(changed, &Group{Source: source(filename, i)})
+		}
+		d.files[filename] = fileState{
+			modTime: info.ModTime(),
+			groups:  len(groups),
+		}
+	}
+
+	for filename, state := range d.files {
+		if found[filename] {
+			continue
+		}
+		for i := 0; i < state.groups; i++ {
+			changed = append(changed, &Group{Source: source(filename, i)})
+		}
+		delete(d.files, filename)
+	}
+
+	return changed
+}
+
+// readFile reads the groups of a JSON or YAML file
+func readFile(filename string) ([]*Group, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetGroups []targetGroup
+	switch filepath.Ext(filename) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&targetGroups)
+	default:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&targetGroups)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newGroups(targetGroups, filename, map[string]string{
+		"__meta_filepath": filename,
+	})
+}
+
+// newGroups converts the target groups read from a file or url, the meta labels
+// are added to every group
+func newGroups(targetGroups []targetGroup, location string, meta map[string]string) ([]*Group, error) {
+	var groups []*Group
+	for i, tg := range targetGroups {
+		group := &Group{
+			Source: source(location, i),
+			Labels: map[string]string{},
+		}
+		for name, value := range meta {
+			group.Labels[name] = value
+		}
+		for name, value := range tg.Labels {
+			group.Labels[name] = value
+		}
+		for _, target := range tg.Targets {
+			if target == "" {
+				return nil, errors.New(fmt.Sprintf("empty target in group %v", i))
+			}
+			group.Targets = append(group.Targets, map[string]string{
+				"__address__": target,
+			})
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
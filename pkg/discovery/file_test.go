@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"scrape/pkg/config"
+	"testing"
+	"time"
+)
+
+func Test_ReadFile(t *testing.T) {
+	type testcase struct {
+		filename    string
+		data        string
+		wantGroups  int
+		wantTargets []string
+		wantLabels  map[string]string
+		wantError   bool
+	}
+
+	testcases := []testcase{
+		{
+			filename:    "targets.json",
+			data:        `[{"targets": ["a:9100", "b:9100"], "labels": {"env": "prod"}}, {"targets": ["c:9100"]}]`,
+			wantGroups:  2,
+			wantTargets: []string{"a:9100", "b:9100"},
+			wantLabels:  map[string]string{"env": "prod"},
+		},
+		{
+			filename:    "targets.yml",
+			data:        "- targets: [a:9100]\n  labels:\n    env: dev\n",
+			wantGroups:  1,
+			wantTargets: []string{"a:9100"},
+			wantLabels:  map[string]string{"env": "dev"},
+		},
+		{
+			filename: "empty.yaml",
+			data:     "",
+		},
+		{
+			filename:  "unknown.json",
+			data:      `[{"targets": ["a:9100"], "lables": {"env": "prod"}}]`,
+			wantError: true,
+		},
+		{
+			filename:  "empty-target.yml",
+			data:      "- targets: ['']\n",
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		filename := filepath.Join(t.TempDir(), tc.filename)
+		err := os.WriteFile(filename, []byte(tc.data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		groups, err := readFile(filename)
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(groups) != tc.wantGroups {
+			t.Fatalf("unexpected number of groups, wanted %v, got %v", tc.wantGroups, len(groups))
+		}
+		if tc.wantGroups == 0 {
+			continue
+		}
+
+		group := groups[0]
+		if group.Source != filename+":0" {
+			t.Fatalf("unexpected source %v", group.Source)
+		}
+		if len(group.Targets) != len(tc.wantTargets) {
+			t.Fatalf("unexpected targets, wanted %v, got %v", tc.wantTargets, group.Targets)
+		}
+		for i, target := range tc.wantTargets {
+			if group.Targets[i]["__address__"] != target {
+				t.Fatalf("unexpected targets, wanted %v, got %v", tc.wantTargets, group.Targets)
+			}
+		}
+		for name, value := range tc.wantLabels {
+			if group.Labels[name] != value {
+				t.Fatalf("unexpected labels, wanted %v, got %v", tc.wantLabels, group.Labels)
+			}
+		}
+		if group.Labels["__meta_filepath"] != filename {
+			t.Fatalf("missing __meta_filepath label: %v", group.Labels)
+		}
+	}
+}
+
+func Test_FileDiscovererRefresh(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.json")
+	second := filepath.Join(dir, "second.json")
+
+	write := func(filename string, data string, modTime time.Time) {
+		err := os.WriteFile(filename, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filename, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewFileDiscoverer(&config.FileSDConfig{
+		Files:           []string{filepath.Join(dir, "*.json")},
+		RefreshInterval: config.Duration(time.Minute),
+	})
+
+	now := time.Now()
+	write(first, `[{"targets": ["a:9100"]}, {"targets": ["b:9100"]}]`, now)
+	write(second, `[{"targets": ["c:9100"]}]`, now)
+
+	type testcase struct {
+		change      func()
+		wantSources []string
+		wantEmpty   []bool
+	}
+
+	testcases := []testcase{
+		{
+			change:      func() {},
+			wantSources: []string{first + ":0", first + ":1", second + ":0"},
+			wantEmpty:   []bool{false, false, false},
+		},
+		{
+			// nothing changed
+			change: func() {},
+		},
+		{
+			change: func() {
+				write(first, `[{"targets": ["a:9100"]}]`, now.Add(time.Second))
+			},
+			wantSources: []string{first + ":0", first + ":1"},
+			wantEmpty:   []bool{false, true},
+		},
+		{
+			// invalid files keep their groups
+			change: func() {
+				write(second, `[{"targets": [`, now.Add(time.Second))
+			},
+		},
+		{
+			change: func() {
+				os.Remove(second)
+			},
+			wantSources: []string{second + ":0"},
+			wantEmpty:   []bool{true},
+		},
+	}
+
+	for i, tc := range testcases {
+		tc.change()
+		groups := d.refresh()
+		if len(groups) != len(tc.wantSources) {
+			t.Fatalf("refresh %v: unexpected groups %v", i, groups)
+		}
+		for j, group := range groups {
+			if group.Source != tc.wantSources[j] || (len(group.Targets) == 0) != tc.wantEmpty[j] {
+				t.Fatalf("refresh %v: unexpected group %v", i, group)
+			}
+		}
+	}
+}
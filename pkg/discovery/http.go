@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"scrape/pkg/config"
+	"time"
+)
+
+// HTTPDiscoverer polls a url for target groups in the Prometheus HTTP SD format,
+// a JSON list of objects with targets and labels
+type HTTPDiscoverer struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	// groups is the number of groups returned by the last successful request
+	groups int
+}
+
+func NewHTTPDiscoverer(c *config.HTTPSDConfig) (*HTTPDiscoverer, error) {
+	client, err := config.NewHTTPClient(c.HTTPClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPDiscoverer{
+		url:      c.URL,
+		interval: time.Duration(c.RefreshInterval),
+		client:   client,
+	}, nil
+}
+
+func (d *HTTPDiscoverer) Run(updates chan<- []*Group, quit <-chan bool) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		groups, err := d.refresh()
+		if err != nil {
+			// the groups fetched last remain until the url responds again
+			log.Printf("[discovery] fetching %v failed: %v", d.url, err)
+		} else {
+			select {
+			case updates <- groups:
+			case <-quit:
+				return
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh fetches all groups and returns them along with empty groups for the
+// groups that are gone
+func (d *HTTPDiscoverer) refresh() ([]*Group, error) {
+	groups, err := d.fetch()
+	if err != nil {
+		return nil, err
+	}
+	changed := groups
+	for i := len(groups); i < d.groups; i++ {
+		changed = append(changed, &Group{Source: source(d.url, i)})
+	}
+	d.groups = len(groups)
+	return changed, nil
+}
+
+// fetch requests the groups, a request is limited to the refresh interval
+func (d *HTTPDiscoverer) fetch() ([]*Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("unexpected status %v", resp.Status))
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil, errors.New(fmt.Sprintf("unexpected content type %q", resp.Header.Get("Content-Type")))
+	}
+
+	var targetGroups []targetGroup
+	decoder := json.NewDecoder(resp.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&targetGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGroups(targetGroups, d.url, map[string]string{
+		"__meta_url": d.url,
+	})
+}
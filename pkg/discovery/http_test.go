@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"scrape/pkg/config"
+	"testing"
+	"time"
+)
+
+func Test_HTTPDiscovererRefresh(t *testing.T) {
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	d, err := NewHTTPDiscoverer(&config.HTTPSDConfig{
+		URL:             server.URL,
+		RefreshInterval: config.Duration(time.Minute),
+		HTTPClientConfig: config.HTTPClientConfig{
+			BearerToken: "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testcase struct {
+		contentType string
+		body        string
+		wantSources []string
+		wantEmpty   []bool
+		wantError   bool
+	}
+
+	testcases := []testcase{
+		{
+			contentType: "application/json; charset=utf-8",
+			body:        `[{"targets": ["a:9100"], "labels": {"env": "prod"}}, {"targets": ["b:9100"]}]`,
+			wantSources: []string{server.URL + ":0", server.URL + ":1"},
+			wantEmpty:   []bool{false, false},
+		},
+		{
+			// groups that are gone are removed
+			contentType: "application/json",
+			body:        `[{"targets": ["a:9100"]}]`,
+			wantSources: []string{server.URL + ":0", server.URL + ":1"},
+			wantEmpty:   []bool{false, true},
+		},
+		{
+			contentType: "text/plain",
+			body:        `[{"targets": ["a:9100"]}]`,
+			wantError:   true,
+		},
+		{
+			contentType: "application/json",
+			body:        `[{"targets": ["a:9100"], "lables": {}}]`,
+			wantError:   true,
+		},
+		{
+			contentType: "application/json",
+			body:        `[]`,
+			wantSources: []string{server.URL + ":0"},
+			wantEmpty:   []bool{true},
+		},
+	}
+
+	for i, tc := range testcases {
+		contentType = tc.contentType
+		body = tc.body
+
+		groups, err := d.refresh()
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("refresh %v: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("refresh %v: unexpected error: %v", i, err)
+		}
+		if len(groups) != len(tc.wantSources) {
+			t.Fatalf("refresh %v: unexpected groups %v", i, groups)
+		}
+		for j, group := range groups {
+			if group.Source != tc.wantSources[j] || (len(group.Targets) == 0) != tc.wantEmpty[j] {
+				t.Fatalf("refresh %v: unexpected group %v", i, group)
+			}
+			if !tc.wantEmpty[j] && group.Labels["__meta_url"] != server.URL {
+				t.Fatalf("refresh %v: missing __meta_url label: %v", i, group.Labels)
+			}
+		}
+	}
+}
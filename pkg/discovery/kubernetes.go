@@ -0,0 +1,314 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"scrape/pkg/config"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesRetry is the time to wait before listing again after an error
+	kubernetesRetry = 5 * time.Second
+)
+
+// objectList is a list response, the items are decoded by the role
+type objectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// watchEvent is a single change of a watch response, the object of an ERROR
+// event is a status
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// kubernetesWatch is the list and watch state of a single namespace
+type kubernetesWatch struct {
+	namespace string
+	// version is the resource version to resume watching from, it is empty
+	// when the objects have to be listed again
+	version string
+	sources map[string]bool
+}
+
+// KubernetesDiscoverer lists the objects of a role and watches them for
+// changes, every object becomes a group
+type KubernetesDiscoverer struct {
+	server     *url.URL
+	role       kubernetesRole
+	namespaces []string
+	client     *http.Client
+	retry      time.Duration
+}
+
+func NewKubernetesDiscoverer(c *config.KubernetesSDConfig) (*KubernetesDiscoverer, error) {
+	server := c.APIServer
+	clientConfig := c.HTTPClientConfig
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("api_server is required when not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+		clientConfig.BearerTokenFile = path.Join(serviceAccountDir, "token")
+		clientConfig.TLSConfig.CAFile = path.Join(serviceAccountDir, "ca.crt")
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	client, err := config.NewHTTPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	role := kubernetesRoles[c.Role]
+	namespaces := c.Namespaces.Names
+	if len(namespaces) == 0 || !role.namespaced {
+		namespaces = []string{""}
+	}
+	return &KubernetesDiscoverer{
+		server:     u,
+		role:       role,
+		namespaces: namespaces,
+		client:     client,
+		retry:      kubernetesRetry,
+	}, nil
+}
+
+func (d *KubernetesDiscoverer) Run(updates chan<- []*Group, quit <-chan bool) {
+	// closing quit cancels all requests
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	send := func(groups []*Group) bool {
+		select {
+		case updates <- groups:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d.retry):
+			return true
+		}
+	}
+
+	// the first update contains the objects of all namespaces
+	var groups []*Group
+	var watches []*kubernetesWatch
+	for _, namespace := range d.namespaces {
+		w := &kubernetesWatch{
+			namespace: namespace,
+			sources:   map[string]bool{},
+		}
+		for {
+			listed, err := d.list(ctx, w)
+			if err == nil {
+				groups = append(groups, listed...)
+				break
+			}
+			log.Printf("[discovery] listing %v failed: %v", d.url(w, false), err)
+			if !wait() {
+				return
+			}
+		}
+		watches = append(watches, w)
+	}
+	if !send(groups) {
+		return
+	}
+
+	for _, w := range watches {
+		go d.watchNamespace(ctx, w, send, wait)
+	}
+}
+
+// watchNamespace keeps watching a namespace until the context is cancelled, the
+// objects are listed again whenever the watch fails
+func (d *KubernetesDiscoverer) watchNamespace(ctx context.Context, w *kubernetesWatch, send func([]*Group) bool, wait func() bool) {
+	for {
+		if w.version == "" {
+			groups, err := d.list(ctx, w)
+			if err != nil {
+				log.Printf("[discovery] listing %v failed: %v", d.url(w, false), err)
+				if !wait() {
+					return
+				}
+				continue
+			}
+			if !send(groups) {
+				return
+			}
+		}
+
+		err := d.watch(ctx, w, send)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[discovery] watching %v failed: %v", d.url(w, true), err)
+			w.version = ""
+			if !wait() {
+				return
+			}
+		}
+	}
+}
+
+// url returns the url to list or watch the objects of a namespace
+func (d *KubernetesDiscoverer) url(w *kubernetesWatch, watch bool) string {
+	u := *d.server
+	if w.namespace != "" {
+		u.Path = path.Join(u.Path, "/api/v1/namespaces", w.namespace, d.role.resource)
+	} else {
+		u.Path = path.Join(u.Path, "/api/v1", d.role.resource)
+	}
+	if watch {
+		u.RawQuery = url.Values{
+			"watch":               {"true"},
+			"resourceVersion":     {w.version},
+			"allowWatchBookmarks": {"true"},
+		}.Encode()
+	}
+	return u.String()
+}
+
+func (d *KubernetesDiscoverer) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("unexpected status %v", resp.Status))
+	}
+	return resp, nil
+}
+
+// list returns the groups of all objects in a namespace and empty groups for
+// the objects that are gone since the last list or watch
+func (d *KubernetesDiscoverer) list(ctx context.Context, w *kubernetesWatch) ([]*Group, error) {
+	resp, err := d.get(ctx, d.url(w, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list objectList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*Group
+	sources := map[string]bool{}
+	for _, item := range list.Items {
+		group, err := d.role.group(item)
+		if err != nil {
+			return nil, err
+		}
+		sources[group.Source] = true
+		groups = append(groups, group)
+	}
+	for source := range w.sources {
+		if !sources[source] {
+			groups = append(groups, &Group{Source: source})
+		}
+	}
+
+	w.sources = sources
+	w.version = list.Metadata.ResourceVersion
+	return groups, nil
+}
+
+// watch sends a group for every change until the server ends the watch
+func (d *KubernetesDiscoverer) watch(ctx context.Context, w *kubernetesWatch, send func([]*Group) bool) error {
+	resp, err := d.get(ctx, d.url(w, true))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var object struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED", "BOOKMARK":
+			err = json.Unmarshal(event.Object, &object)
+			if err != nil {
+				return err
+			}
+		case "ERROR":
+			var s status
+			json.Unmarshal(event.Object, &s)
+			return errors.New(fmt.Sprintf("watch error %v: %v", s.Code, s.Message))
+		default:
+			return errors.New(fmt.Sprintf("unknown watch event %q", event.Type))
+		}
+		w.version = object.Metadata.ResourceVersion
+
+		var group *Group
+		switch event.Type {
+		case "BOOKMARK":
+			continue
+		case "DELETED":
+			group = &Group{Source: objectSource(d.role.resource, object.Metadata)}
+			delete(w.sources, group.Source)
+		default:
+			group, err = d.role.group(event.Object)
+			if err != nil {
+				return err
+			}
+			w.sources[group.Source] = true
+		}
+		if !send([]*Group{group}) {
+			return nil
+		}
+	}
+}
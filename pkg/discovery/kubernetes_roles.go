@@ -0,0 +1,330 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const kubernetesMetaPrefix = "__meta_kubernetes_"
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// the parts of the Kubernetes API objects that targets are built from
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+	OwnerReferences []struct {
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Controller bool   `json:"controller"`
+	} `json:"ownerReferences"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name  string `json:"name"`
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+				Protocol      string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		PodIP      string `json:"podIP"`
+		HostIP     string `json:"hostIP"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Type      string `json:"type"`
+		ClusterIP string `json:"clusterIP"`
+		Ports     []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type endpointAddress struct {
+	IP        string `json:"ip"`
+	Hostname  string `json:"hostname"`
+	NodeName  string `json:"nodeName"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
+
+type endpoints struct {
+	Metadata objectMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses         []endpointAddress `json:"addresses"`
+		NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+		Ports             []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type node struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		DaemonEndpoints struct {
+			KubeletEndpoint struct {
+				Port int `json:"Port"`
+			} `json:"kubeletEndpoint"`
+		} `json:"daemonEndpoints"`
+	} `json:"status"`
+}
+
+// kubernetesRole describes how the objects of a role are listed and turned into
+// a group of targets
+type kubernetesRole struct {
+	resource   string
+	namespaced bool
+	group      func(data []byte) (*Group, error)
+}
+
+var kubernetesRoles = map[string]kubernetesRole{
+	"pod":       {resource: "pods", namespaced: true, group: podGroup},
+	"service":   {resource: "services", namespaced: true, group: serviceGroup},
+	"endpoints": {resource: "endpoints", namespaced: true, group: endpointsGroup},
+	"node":      {resource: "nodes", namespaced: false, group: nodeGroup},
+}
+
+// objectSource identifies the group of an object by its kind, namespace and name
+func objectSource(resource string, meta objectMeta) string {
+	if meta.Namespace == "" {
+		return fmt.Sprintf("%v/%v", resource, meta.Name)
+	}
+	return fmt.Sprintf("%v/%v/%v", resource, meta.Namespace, meta.Name)
+}
+
+// objectLabels adds the labels and annotations of an object, names that are not
+// valid label names are sanitized
+func objectLabels(labels map[string]string, prefix string, meta objectMeta) {
+	for name, value := range meta.Labels {
+		name = invalidLabelChars.ReplaceAllString(name, "_")
+		labels[prefix+"_label_"+name] = value
+		labels[prefix+"_labelpresent_"+name] = "true"
+	}
+	for name, value := range meta.Annotations {
+		name = invalidLabelChars.ReplaceAllString(name, "_")
+		labels[prefix+"_annotation_"+name] = value
+		labels[prefix+"_annotationpresent_"+name] = "true"
+	}
+}
+
+// podGroup has a target for every container port of a pod, containers without
+// ports get a target with the pod IP only
+func podGroup(data []byte) (*Group, error) {
+	var p pod
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := kubernetesMetaPrefix + "pod"
+	group := &Group{
+		Source: objectSource("pods", p.Metadata),
+		Labels: map[string]string{
+			kubernetesMetaPrefix + "namespace": p.Metadata.Namespace,
+			prefix + "_name":                   p.Metadata.Name,
+			prefix + "_uid":                    p.Metadata.UID,
+			prefix + "_ip":                     p.Status.PodIP,
+			prefix + "_host_ip":                p.Status.HostIP,
+			prefix + "_node_name":              p.Spec.NodeName,
+			prefix + "_phase":                  p.Status.Phase,
+			prefix + "_ready":                  "unknown",
+		},
+	}
+	objectLabels(group.Labels, prefix, p.Metadata)
+	for _, condition := range p.Status.Conditions {
+		if condition.Type == "Ready" {
+			group.Labels[prefix+"_ready"] = strings.ToLower(condition.Status)
+		}
+	}
+	for _, owner := range p.Metadata.OwnerReferences {
+		if owner.Controller {
+			group.Labels[prefix+"_controller_kind"] = owner.Kind
+			group.Labels[prefix+"_controller_name"] = owner.Name
+		}
+	}
+
+	// pods are only scraped once they have an IP
+	if p.Status.PodIP == "" {
+		return group, nil
+	}
+	for _, container := range p.Spec.Containers {
+		if len(container.Ports) == 0 {
+			group.Targets = append(group.Targets, map[string]string{
+				"__address__":              p.Status.PodIP,
+				prefix + "_container_name": container.Name,
+			})
+			continue
+		}
+		for _, port := range container.Ports {
+			number := strconv.Itoa(port.ContainerPort)
+			group.Targets = append(group.Targets, map[string]string{
+				"__address__":                       net.JoinHostPort(p.Status.PodIP, number),
+				prefix + "_container_name":          container.Name,
+				prefix + "_container_port_name":     port.Name,
+				prefix + "_container_port_number":   number,
+				prefix + "_container_port_protocol": port.Protocol,
+			})
+		}
+	}
+	return group, nil
+}
+
+// serviceGroup has a target for every port of a service, addressed by its DNS
+// name
+func serviceGroup(data []byte) (*Group, error) {
+	var s service
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := kubernetesMetaPrefix + "service"
+	group := &Group{
+		Source: objectSource("services", s.Metadata),
+		Labels: map[string]string{
+			kubernetesMetaPrefix + "namespace": s.Metadata.Namespace,
+			prefix + "_name":                   s.Metadata.Name,
+			prefix + "_type":                   s.Spec.Type,
+			prefix + "_cluster_ip":             s.Spec.ClusterIP,
+		},
+	}
+	objectLabels(group.Labels, prefix, s.Metadata)
+
+	host := fmt.Sprintf("%v.%v.svc", s.Metadata.Name, s.Metadata.Namespace)
+	for _, port := range s.Spec.Ports {
+		number := strconv.Itoa(port.Port)
+		group.Targets = append(group.Targets, map[string]string{
+			"__address__":             net.JoinHostPort(host, number),
+			prefix + "_port_name":     port.Name,
+			prefix + "_port_number":   number,
+			prefix + "_port_protocol": port.Protocol,
+		})
+	}
+	return group, nil
+}
+
+// endpointsGroup has a target for every port of every address of an endpoints
+// object, including addresses that are not ready
+func endpointsGroup(data []byte) (*Group, error) {
+	var e endpoints
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := kubernetesMetaPrefix + "endpoint"
+	group := &Group{
+		Source: objectSource("endpoints", e.Metadata),
+		Labels: map[string]string{
+			kubernetesMetaPrefix + "namespace":      e.Metadata.Namespace,
+			kubernetesMetaPrefix + "endpoints_name": e.Metadata.Name,
+			// endpoints have the name of their service
+			kubernetesMetaPrefix + "service_name": e.Metadata.Name,
+		},
+	}
+	objectLabels(group.Labels, kubernetesMetaPrefix+"endpoints", e.Metadata)
+
+	add := func(address endpointAddress, ready string, name string, number int, protocol string) {
+		target := map[string]string{
+			"__address__":             net.JoinHostPort(address.IP, strconv.Itoa(number)),
+			prefix + "_ready":         ready,
+			prefix + "_port_name":     name,
+			prefix + "_port_protocol": protocol,
+			prefix + "_hostname":      address.Hostname,
+			prefix + "_node_name":     address.NodeName,
+		}
+		if address.TargetRef != nil {
+			target[prefix+"_address_target_kind"] = address.TargetRef.Kind
+			target[prefix+"_address_target_name"] = address.TargetRef.Name
+		}
+		group.Targets = append(group.Targets, target)
+	}
+	for _, subset := range e.Subsets {
+		for _, port := range subset.Ports {
+			for _, address := range subset.Addresses {
+				add(address, "true", port.Name, port.Port, port.Protocol)
+			}
+			for _, address := range subset.NotReadyAddresses {
+				add(address, "false", port.Name, port.Port, port.Protocol)
+			}
+		}
+	}
+	return group, nil
+}
+
+// nodeAddressTypes is the order in which the address of a node is chosen
+var nodeAddressTypes = []string{"InternalIP", "InternalDNS", "ExternalIP", "ExternalDNS", "Hostname"}
+
+// nodeGroup has a single target for the kubelet of a node
+func nodeGroup(data []byte) (*Group, error) {
+	var n node
+	err := json.Unmarshal(data, &n)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := kubernetesMetaPrefix + "node"
+	group := &Group{
+		Source: objectSource("nodes", n.Metadata),
+		Labels: map[string]string{
+			prefix + "_name": n.Metadata.Name,
+		},
+	}
+	objectLabels(group.Labels, prefix, n.Metadata)
+
+	addresses := map[string]string{}
+	for _, address := range n.Status.Addresses {
+		if _, ok := addresses[address.Type]; !ok {
+			addresses[address.Type] = address.Address
+			group.Labels[prefix+"_address_"+address.Type] = address.Address
+		}
+	}
+	for _, addressType := range nodeAddressTypes {
+		address, ok := addresses[addressType]
+		if !ok {
+			continue
+		}
+		port := strconv.Itoa(n.Status.DaemonEndpoints.KubeletEndpoint.Port)
+		group.Targets = append(group.Targets, map[string]string{
+			"__address__": net.JoinHostPort(address, port),
+			"instance":    n.Metadata.Name,
+		})
+		break
+	}
+	return group, nil
+}
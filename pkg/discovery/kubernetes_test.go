@@ -0,0 +1,331 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"scrape/pkg/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer lists a fixed set of objects and streams the events sent to it
+// to watchers, a watch ends after an ERROR event
+type fakeAPIServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	items   []string
+	version string
+	events  chan string
+	paths   chan string
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	s := &fakeAPIServer{
+		events: make(chan string),
+		paths:  make(chan string, 10),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAPIServer) setItems(version string, items ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.version = version
+	s.items = items
+}
+
+func (s *fakeAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("watch") != "true" {
+		s.paths <- r.URL.Path
+		s.mutex.Lock()
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": %q}, "items": [%v]}`, s.version, strings.Join(s.items, ","))
+		s.mutex.Unlock()
+		return
+	}
+
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-s.events:
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+			if strings.Contains(event, `"ERROR"`) {
+				return
+			}
+		}
+	}
+}
+
+func podJSON(name string, version string, ip string) string {
+	return fmt.Sprintf(`{
+		"metadata": {"name": %q, "namespace": "default", "resourceVersion": %q},
+		"spec": {"containers": [{"name": "app", "ports": [{"name": "metrics", "containerPort": 8080, "protocol": "TCP"}]}]},
+		"status": {"podIP": %q}
+	}`, name, version, ip)
+}
+
+func Test_KubernetesRoles(t *testing.T) {
+	type testcase struct {
+		role        string
+		object      string
+		wantSource  string
+		wantLabels  map[string]string
+		wantTargets []map[string]string
+	}
+
+	testcases := []testcase{
+		{
+			role: "pod",
+			object: `{
+				"metadata": {
+					"name": "web-1", "namespace": "default", "uid": "1234",
+					"labels": {"app.kubernetes.io/name": "web"},
+					"ownerReferences": [{"kind": "ReplicaSet", "name": "web-abc", "controller": true}]
+				},
+				"spec": {
+					"nodeName": "node-1",
+					"containers": [
+						{"name": "app", "ports": [{"name": "metrics", "containerPort": 8080, "protocol": "TCP"}]},
+						{"name": "sidecar"}
+					]
+				},
+				"status": {"phase": "Running", "podIP": "10.1.0.5", "hostIP": "10.0.0.1", "conditions": [{"type": "Ready", "status": "True"}]}
+			}`,
+			wantSource: "pods/default/web-1",
+			wantLabels: map[string]string{
+				"__meta_kubernetes_namespace":                               "default",
+				"__meta_kubernetes_pod_name":                                "web-1",
+				"__meta_kubernetes_pod_uid":                                 "1234",
+				"__meta_kubernetes_pod_node_name":                           "node-1",
+				"__meta_kubernetes_pod_phase":                               "Running",
+				"__meta_kubernetes_pod_ready":                               "true",
+				"__meta_kubernetes_pod_label_app_kubernetes_io_name":        "web",
+				"__meta_kubernetes_pod_labelpresent_app_kubernetes_io_name": "true",
+				"__meta_kubernetes_pod_controller_kind":                     "ReplicaSet",
+				"__meta_kubernetes_pod_controller_name":                     "web-abc",
+			},
+			wantTargets: []map[string]string{
+				{
+					"__address__":                                   "10.1.0.5:8080",
+					"__meta_kubernetes_pod_container_name":          "app",
+					"__meta_kubernetes_pod_container_port_name":     "metrics",
+					"__meta_kubernetes_pod_container_port_number":   "8080",
+					"__meta_kubernetes_pod_container_port_protocol": "TCP",
+				},
+				{
+					"__address__":                          "10.1.0.5",
+					"__meta_kubernetes_pod_container_name": "sidecar",
+				},
+			},
+		},
+		{
+			// pods without an IP have no targets
+			role:       "pod",
+			object:     `{"metadata": {"name": "web-2", "namespace": "default"}, "spec": {"containers": [{"name": "app"}]}}`,
+			wantSource: "pods/default/web-2",
+		},
+		{
+			role: "service",
+			object: `{
+				"metadata": {"name": "web", "namespace": "shop", "annotations": {"prometheus.io/scrape": "true"}},
+				"spec": {"type": "ClusterIP", "clusterIP": "10.96.0.10", "ports": [{"name": "http", "port": 80, "protocol": "TCP"}]}
+			}`,
+			wantSource: "services/shop/web",
+			wantLabels: map[string]string{
+				"__meta_kubernetes_namespace":                                      "shop",
+				"__meta_kubernetes_service_name":                                   "web",
+				"__meta_kubernetes_service_type":                                   "ClusterIP",
+				"__meta_kubernetes_service_cluster_ip":                             "10.96.0.10",
+				"__meta_kubernetes_service_annotation_prometheus_io_scrape":        "true",
+				"__meta_kubernetes_service_annotationpresent_prometheus_io_scrape": "true",
+			},
+			wantTargets: []map[string]string{
+				{
+					"__address__":                             "web.shop.svc:80",
+					"__meta_kubernetes_service_port_name":     "http",
+					"__meta_kubernetes_service_port_number":   "80",
+					"__meta_kubernetes_service_port_protocol": "TCP",
+				},
+			},
+		},
+		{
+			role: "endpoints",
+			object: `{
+				"metadata": {"name": "web", "namespace": "shop"},
+				"subsets": [{
+					"addresses": [{"ip": "10.1.0.5", "nodeName": "node-1", "targetRef": {"kind": "Pod", "name": "web-1"}}],
+					"notReadyAddresses": [{"ip": "10.1.0.6"}],
+					"ports": [{"name": "metrics", "port": 8080, "protocol": "TCP"}]
+				}]
+			}`,
+			wantSource: "endpoints/shop/web",
+			wantLabels: map[string]string{
+				"__meta_kubernetes_namespace":      "shop",
+				"__meta_kubernetes_endpoints_name": "web",
+				"__meta_kubernetes_service_name":   "web",
+			},
+			wantTargets: []map[string]string{
+				{
+					"__address__":                                    "10.1.0.5:8080",
+					"__meta_kubernetes_endpoint_ready":               "true",
+					"__meta_kubernetes_endpoint_port_name":           "metrics",
+					"__meta_kubernetes_endpoint_port_protocol":       "TCP",
+					"__meta_kubernetes_endpoint_hostname":            "",
+					"__meta_kubernetes_endpoint_node_name":           "node-1",
+					"__meta_kubernetes_endpoint_address_target_kind": "Pod",
+					"__meta_kubernetes_endpoint_address_target_name": "web-1",
+				},
+				{
+					"__address__":                              "10.1.0.6:8080",
+					"__meta_kubernetes_endpoint_ready":         "false",
+					"__meta_kubernetes_endpoint_port_name":     "metrics",
+					"__meta_kubernetes_endpoint_port_protocol": "TCP",
+					"__meta_kubernetes_endpoint_hostname":      "",
+					"__meta_kubernetes_endpoint_node_name":     "",
+				},
+			},
+		},
+		{
+			role: "node",
+			object: `{
+				"metadata": {"name": "node-1", "labels": {"kubernetes.io/os": "linux"}},
+				"status": {
+					"addresses": [{"type": "Hostname", "address": "node-1"}, {"type": "InternalIP", "address": "10.0.0.1"}],
+					"daemonEndpoints": {"kubeletEndpoint": {"Port": 10250}}
+				}
+			}`,
+			wantSource: "nodes/node-1",
+			wantLabels: map[string]string{
+				"__meta_kubernetes_node_name":                          "node-1",
+				"__meta_kubernetes_node_label_kubernetes_io_os":        "linux",
+				"__meta_kubernetes_node_labelpresent_kubernetes_io_os": "true",
+				"__meta_kubernetes_node_address_InternalIP":            "10.0.0.1",
+				"__meta_kubernetes_node_address_Hostname":              "node-1",
+			},
+			wantTargets: []map[string]string{
+				{"__address__": "10.0.0.1:10250", "instance": "node-1"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		group, err := kubernetesRoles[tc.role].group([]byte(tc.object))
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.role, err)
+		}
+		if group.Source != tc.wantSource {
+			t.Fatalf("%v: unexpected source, wanted %v, got %v", tc.role, tc.wantSource, group.Source)
+		}
+		for name, value := range tc.wantLabels {
+			if got, ok := group.Labels[name]; !ok || got != value {
+				t.Fatalf("%v: unexpected label %v, wanted %q, got %q", tc.role, name, value, got)
+			}
+		}
+		if len(group.Targets) != len(tc.wantTargets) {
+			t.Fatalf("%v: unexpected targets, wanted %v, got %v", tc.role, tc.wantTargets, group.Targets)
+		}
+		for i, want := range tc.wantTargets {
+			if len(group.Targets[i]) != len(want) {
+				t.Fatalf("%v: unexpected target, wanted %v, got %v", tc.role, want, group.Targets[i])
+			}
+			for name, value := range want {
+				if got, ok := group.Targets[i][name]; !ok || got != value {
+					t.Fatalf("%v: unexpected target, wanted %v, got %v", tc.role, want, group.Targets[i])
+				}
+			}
+		}
+	}
+}
+
+func Test_KubernetesDiscovererRun(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setItems("1", podJSON("web-1", "1", "10.1.0.1"))
+
+	d, err := NewKubernetesDiscoverer(&config.KubernetesSDConfig{
+		APIServer:  server.URL,
+		Role:       "pod",
+		Namespaces: config.KubernetesNamespaces{Names: []string{"default"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.retry = 10 * time.Millisecond
+
+	updates := make(chan []*Group)
+	quit := make(chan bool)
+	defer close(quit)
+	go d.Run(updates, quit)
+
+	receive := func() []*Group {
+		select {
+		case groups := <-updates:
+			return groups
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update received")
+		}
+		return nil
+	}
+
+	type testcase struct {
+		// event is sent to the watch before receiving the update, the
+		// objects are listed again after an ERROR event
+		event       string
+		items       []string
+		wantSources []string
+		wantEmpty   []bool
+	}
+
+	testcases := []testcase{
+		{
+			wantSources: []string{"pods/default/web-1"},
+			wantEmpty:   []bool{false},
+		},
+		{
+			event:       fmt.Sprintf(`{"type": "ADDED", "object": %v}`, podJSON("web-2", "2", "10.1.0.2")),
+			wantSources: []string{"pods/default/web-2"},
+			wantEmpty:   []bool{false},
+		},
+		{
+			event:       fmt.Sprintf(`{"type": "DELETED", "object": %v}`, podJSON("web-1", "3", "10.1.0.1")),
+			wantSources: []string{"pods/default/web-1"},
+			wantEmpty:   []bool{true},
+		},
+		{
+			// web-2 was deleted while the watch was broken
+			event:       `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`,
+			items:       []string{podJSON("web-3", "5", "10.1.0.3")},
+			wantSources: []string{"pods/default/web-3", "pods/default/web-2"},
+			wantEmpty:   []bool{false, true},
+		},
+	}
+
+	if path := <-server.paths; path != "/api/v1/namespaces/default/pods" {
+		t.Fatalf("unexpected path %v", path)
+	}
+	for i, tc := range testcases {
+		if tc.items != nil {
+			server.setItems("5", tc.items...)
+		}
+		if tc.event != "" {
+			server.events <- tc.event
+		}
+
+		groups := receive()
+		if len(groups) != len(tc.wantSources) {
+			t.Fatalf("update %v: unexpected groups %v", i, groups)
+		}
+		for j, group := range groups {
+			if group.Source != tc.wantSources[j] || (len(group.Targets) == 0) != tc.wantEmpty[j] {
+				t.Fatalf("update %v: unexpected group %v", i, group)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package ingest
+
+import "fmt"
+
+// Diagnostic describes a line that was skipped in lenient mode
+type Diagnostic struct {
+	Line   int    `json:"line"`
+	Token  string `json:"token"`
+	Reason string `json:"reason"`
+}
+
+func (d Diagnostic) String() string {
+	if d.Token == "" {
+		return fmt.Sprintf("line %v: %v", d.Line, d.Reason)
+	}
+	return fmt.Sprintf("line %v at %q: %v", d.Line, d.Token, d.Reason)
+}
+
+func describeToken(t *Token) string {
+	if t == nil {
+		return ""
+	}
+	switch t.TokenType {
+	case TokenTypeName, TokenTypeText:
+		return t.StringVal
+	default:
+		return TokenMapping[t.TokenType]
+	}
+}
@@ -0,0 +1,386 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"scrape/api"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// series of a histogram or summary sharing the same labels, apart from le
+// and quantile
+type familySeries struct {
+	// line of the first sample of the series, used to report errors
+	line       int
+	labels     []api.Label
+	timestamp  *int64
+	buckets    []api.Bucket
+	quantiles  []api.Quantile
+	sum        float64
+	count      float64
+	created    float64
+	hasCount   bool
+	hasBuckets map[float64]bool
+}
+
+type familyBuilder struct {
+	metadata api.Metadata
+	series   map[string]*familySeries
+	order    []string
+	// totals are the label sets of the _total series of a counter, a _created
+	// series has to follow the _total series it belongs to
+	totals map[string]bool
+}
+
+func sampleName(sample *api.Sample) string {
+	for _, label := range sample.Labels {
+		if label.Name == "__name__" {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+func seriesKey(labels []api.Label) string {
+	sb := strings.Builder{}
+	for _, label := range labels {
+		sb.WriteString(label.Name)
+		sb.WriteRune('\xff')
+		sb.WriteString(label.Value)
+		sb.WriteRune('\xff')
+	}
+	return sb.String()
+}
+
+func describe(name string, labels []api.Label) string {
+	var pairs []string
+	for _, label := range labels {
+		if label.Name != "__name__" {
+			pairs = append(pairs, fmt.Sprintf("%v=%q", label.Name, label.Value))
+		}
+	}
+	return fmt.Sprintf("%v{%v}", name, strings.Join(pairs, ","))
+}
+
+// split separates the label with the given name from the rest of the labels
+func split(labels []api.Label, name string) ([]api.Label, *api.Label) {
+	var rest []api.Label
+	var found *api.Label
+	for i, label := range labels {
+		if label.Name == name {
+			found = &labels[i]
+			continue
+		}
+		rest = append(rest, label)
+	}
+	return rest, found
+}
+
+func newFamilyBuilder(metadata api.Metadata) *familyBuilder {
+	return &familyBuilder{
+		metadata: metadata,
+		series:   map[string]*familySeries{},
+		totals:   map[string]bool{},
+	}
+}
+
+// suffixes returns the series name suffixes belonging to the family
+func (f *familyBuilder) suffixes() []string {
+	switch f.metadata.Type {
+	case api.MetricTypeHistogram:
+		return []string{"_bucket", "_sum", "_count", "_created"}
+	case api.MetricTypeGaugeHistogram:
+		return []string{"_bucket", "_gsum", "_gcount"}
+	case api.MetricTypeSummary:
+		return []string{"", "_sum", "_count", "_created"}
+	case api.MetricTypeCounter:
+		return []string{"_total", "_created"}
+	case api.MetricTypeInfo:
+		return []string{"_info"}
+	case api.MetricTypeStateSet:
+		return []string{""}
+	default:
+		return nil
+	}
+}
+
+// grouped returns true if the series of the family are assembled into
+// histograms or summaries, all other families are only validated. Gauge
+// histograms are grouped to be validated and then passed on as samples.
+func (f *familyBuilder) grouped() bool {
+	switch f.metadata.Type {
+	case api.MetricTypeHistogram, api.MetricTypeGaugeHistogram, api.MetricTypeSummary:
+		return true
+	}
+	return false
+}
+
+// checkExemplar rejects exemplars on samples other than counter totals and
+// histogram buckets, b is nil for samples that are not part of a family
+func checkExemplar(sample *api.Sample, b *familyBuilder, suffix string) error {
+	if sample.Exemplar == nil {
+		return nil
+	}
+	if b != nil {
+		switch b.metadata.Type {
+		case api.MetricTypeCounter:
+			if suffix == "_total" {
+				return nil
+			}
+		case api.MetricTypeHistogram, api.MetricTypeGaugeHistogram:
+			if suffix == "_bucket" {
+				return nil
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("exemplar on %v, exemplars are only allowed on counters and histogram buckets", describe(sampleName(sample), sample.Labels)))
+}
+
+// validate checks the samples of families that are not grouped
+func (f *familyBuilder) validate(sample *api.Sample, suffix string) error {
+	name := f.metadata.Name
+	switch f.metadata.Type {
+	case api.MetricTypeCounter:
+		labels, _ := split(sample.Labels, "__name__")
+		if suffix == "_created" {
+			if !f.totals[seriesKey(labels)] {
+				return errors.New(fmt.Sprintf("counter %v does not follow its _total series", describe(name+"_created", sample.Labels)))
+			}
+			return nil
+		}
+		if math.IsNaN(sample.Value) || sample.Value < 0 {
+			return errors.New(fmt.Sprintf("counter %v has invalid value %v", describe(name+"_total", sample.Labels), sample.Value))
+		}
+		f.totals[seriesKey(labels)] = true
+	case api.MetricTypeInfo:
+		if sample.Value != 1 {
+			return errors.New(fmt.Sprintf("info %v must have value 1 but has %v", describe(name+"_info", sample.Labels), sample.Value))
+		}
+	case api.MetricTypeStateSet:
+		_, state := split(sample.Labels, name)
+		if state == nil {
+			return errors.New(fmt.Sprintf("stateset %v is missing the %v label", describe(name, sample.Labels), name))
+		}
+		if sample.Value != 0 && sample.Value != 1 {
+			return errors.New(fmt.Sprintf("stateset %v must have value 0 or 1 but has %v", describe(name, sample.Labels), sample.Value))
+		}
+	}
+	return nil
+}
+
+func (f *familyBuilder) get(labels []api.Label, timestamp *int64, line int) *familySeries {
+	key := seriesKey(labels)
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s := &familySeries{
+		line:       line,
+		labels:     append([]api.Label{{Name: "__name__", Value: f.metadata.Name}}, labels...),
+		timestamp:  timestamp,
+		hasBuckets: map[float64]bool{},
+	}
+	f.series[key] = s
+	f.order = append(f.order, key)
+	return s
+}
+
+// add collects the sample read in the given line into its series
+func (f *familyBuilder) add(sample *api.Sample, suffix string, line int) error {
+	labels, _ := split(sample.Labels, "__name__")
+	name := f.metadata.Name + suffix
+
+	switch suffix {
+	case "_sum", "_gsum":
+		f.get(labels, sample.Timestamp, line).sum = sample.Value
+	case "_created":
+		f.get(labels, sample.Timestamp, line).created = sample.Value
+	case "_count", "_gcount":
+		s := f.get(labels, sample.Timestamp, line)
+		s.count = sample.Value
+		s.hasCount = true
+	case "_bucket":
+		rest, le := split(labels, "le")
+		if le == nil {
+			return errors.New(fmt.Sprintf("histogram bucket %v is missing the le label", describe(name, labels)))
+		}
+		upperBound, err := strconv.ParseFloat(le.Value, 64)
+		if err != nil || math.IsNaN(upperBound) {
+			return errors.New(fmt.Sprintf("histogram bucket %v has an invalid le label", describe(name, labels)))
+		}
+		s := f.get(rest, sample.Timestamp, line)
+		if s.hasBuckets[upperBound] {
+			return errors.New(fmt.Sprintf("histogram bucket %v is duplicated", describe(name, labels)))
+		}
+		s.hasBuckets[upperBound] = true
+		s.buckets = append(s.buckets, api.Bucket{
+			UpperBound: upperBound,
+			Count:      sample.Value,
+		})
+	case "":
+		rest, quantile := split(labels, "quantile")
+		if quantile == nil {
+			return errors.New(fmt.Sprintf("summary %v is missing the quantile label", describe(name, labels)))
+		}
+		q, err := strconv.ParseFloat(quantile.Value, 64)
+		if err != nil || q < 0 || q > 1 {
+			return errors.New(fmt.Sprintf("summary %v has an invalid quantile label", describe(name, labels)))
+		}
+		s := f.get(rest, sample.Timestamp, line)
+		s.quantiles = append(s.quantiles, api.Quantile{
+			Quantile: q,
+			Value:    sample.Value,
+		})
+	}
+	return nil
+}
+
+func (f *familyBuilder) histogram(s *familySeries) (*api.Histogram, error) {
+	sort.Slice(s.buckets, func(i, j int) bool {
+		return s.buckets[i].UpperBound < s.buckets[j].UpperBound
+	})
+
+	if len(s.buckets) == 0 || !math.IsInf(s.buckets[len(s.buckets)-1].UpperBound, 1) {
+		return nil, errors.New(fmt.Sprintf("histogram %v has no +Inf bucket", describe(f.metadata.Name, s.labels)))
+	}
+
+	for i := 1; i < len(s.buckets); i++ {
+		if s.buckets[i].Count < s.buckets[i-1].Count {
+			return nil, errors.New(fmt.Sprintf("histogram %v has non-monotonic buckets", describe(f.metadata.Name, s.labels)))
+		}
+	}
+
+	inf := s.buckets[len(s.buckets)-1].Count
+	if s.hasCount && s.count != inf {
+		return nil, errors.New(fmt.Sprintf("histogram %v count %v does not match +Inf bucket %v", describe(f.metadata.Name, s.labels), s.count, inf))
+	}
+
+	return &api.Histogram{
+		Labels:    s.labels,
+		Buckets:   s.buckets,
+		Sum:       s.sum,
+		Count:     inf,
+		Timestamp: s.timestamp,
+		Created:   s.created,
+	}, nil
+}
+
+func (f *familyBuilder) summary(s *familySeries) *api.Summary {
+	sort.Slice(s.quantiles, func(i, j int) bool {
+		return s.quantiles[i].Quantile < s.quantiles[j].Quantile
+	})
+
+	return &api.Summary{
+		Labels:    s.labels,
+		Quantiles: s.quantiles,
+		Sum:       s.sum,
+		Count:     s.count,
+		Timestamp: s.timestamp,
+		Created:   s.created,
+	}
+}
+
+// build validates the collected series and assembles the family, gauge
+// histograms are returned as samples like in the protobuf format. Invalid
+// series are passed to diagnose along with their line, in lenient mode only
+// they are dropped and the rest of the family is kept.
+func (f *familyBuilder) build(diagnose func(int, string, error) error) (*api.Family, []api.Sample, error) {
+	family := &api.Family{
+		Metadata: f.metadata,
+	}
+
+	var samples []api.Sample
+	for _, key := range f.order {
+		s := f.series[key]
+		switch f.metadata.Type {
+		case api.MetricTypeHistogram, api.MetricTypeGaugeHistogram:
+			h, err := f.histogram(s)
+			if err != nil {
+				err = diagnose(s.line, f.metadata.Name, err)
+				if err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			if f.metadata.Type == api.MetricTypeGaugeHistogram {
+				samples = append(samples, h.GaugeSamples(f.metadata.Name)...)
+				continue
+			}
+			family.Histograms = append(family.Histograms, *h)
+		case api.MetricTypeSummary:
+			family.Summaries = append(family.Summaries, *f.summary(s))
+		}
+	}
+
+	return family, samples, nil
+}
+
+// groupFamilies moves the series of histograms and summaries out of the flat
+// sample list into their families. Errors are passed to diagnose along with the
+// line of the sample, in lenient mode the sample or family is dropped.
+func groupFamilies(samples []api.Sample, lines []int, metadata []api.Metadata, diagnose func(int, string, error) error) ([]api.Sample, []api.Family, error) {
+	var builders []*familyBuilder
+	index := map[string]*familyBuilder{}
+	for _, m := range metadata {
+		b := newFamilyBuilder(m)
+		builders = append(builders, b)
+		for _, suffix := range b.suffixes() {
+			index[m.Name+suffix] = b
+		}
+	}
+
+	var rest []api.Sample
+	for i := range samples {
+		name := sampleName(&samples[i])
+		b := index[name]
+		suffix := ""
+		if b != nil {
+			suffix = strings.TrimPrefix(name, b.metadata.Name)
+		}
+		err := checkExemplar(&samples[i], b, suffix)
+		if err != nil {
+			err = diagnose(lines[i], name, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if b == nil {
+			rest = append(rest, samples[i])
+			continue
+		}
+		if !b.grouped() {
+			err := b.validate(&samples[i], suffix)
+			if err != nil {
+				err = diagnose(lines[i], name, err)
+				if err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			rest = append(rest, samples[i])
+			continue
+		}
+		err = b.add(&samples[i], suffix, lines[i])
+		if err != nil {
+			err = diagnose(lines[i], name, err)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	var families []api.Family
+	for _, b := range builders {
+		family, gauges, err := b.build(diagnose)
+		if err != nil {
+			return nil, nil, err
+		}
+		rest = append(rest, gauges...)
+		families = append(families, *family)
+	}
+
+	return rest, families, nil
+}
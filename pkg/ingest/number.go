@@ -0,0 +1,106 @@
+package ingest
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// isDecimal reports whether s is a decimal real number: an optional sign,
+// digits with an optional fraction and an optional exponent. Hex floats and
+// digit separators accepted by strconv.ParseFloat are not part of the
+// exposition formats.
+func isDecimal(s string) bool {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+
+	digits := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return false
+	}
+
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		exponent := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+			exponent++
+		}
+		if exponent == 0 {
+			return false
+		}
+	}
+
+	return i == len(s)
+}
+
+// special parses the non-finite values, the Prometheus text format only knows
+// NaN, +Inf and -Inf while OpenMetrics is case-insensitive and also allows
+// infinity to be spelled out
+func special(s string, openMetrics bool) (float64, bool) {
+	if !openMetrics {
+		switch s {
+		case "NaN":
+			return math.NaN(), true
+		case "+Inf":
+			return math.Inf(1), true
+		case "-Inf":
+			return math.Inf(-1), true
+		}
+		return 0, false
+	}
+
+	lower := strings.ToLower(s)
+	if lower == "nan" {
+		return math.NaN(), true
+	}
+
+	sign := 1
+	if strings.HasPrefix(lower, "+") || strings.HasPrefix(lower, "-") {
+		if lower[0] == '-' {
+			sign = -1
+		}
+		lower = lower[1:]
+	}
+	if lower == "inf" || lower == "infinity" {
+		return math.Inf(sign), true
+	}
+	return 0, false
+}
+
+// parseNumber parses a sample or exemplar value
+func parseNumber(s string, openMetrics bool) (float64, bool) {
+	if f, ok := special(s, openMetrics); ok {
+		return f, true
+	}
+
+	if !isDecimal(s) {
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func Test_ParserValues(t *testing.T) {
+	type testcase struct {
+		value       string
+		openMetrics bool
+		wantError   bool
+		wantValue   float64
+	}
+
+	testcases := []testcase{
+		{value: "1", wantValue: 1},
+		{value: "-1.5", wantValue: -1.5},
+		{value: "+.5", wantValue: 0.5},
+		{value: "5.", wantValue: 5},
+		{value: "1e3", wantValue: 1000},
+		{value: "1.5E-3", wantValue: 0.0015},
+		{value: "NaN", wantValue: math.NaN()},
+		{value: "+Inf", wantValue: math.Inf(1)},
+		{value: "-Inf", wantValue: math.Inf(-1)},
+		{value: "nan", wantError: true},
+		{value: "Inf", wantError: true},
+		{value: "inf", wantError: true},
+		{value: "Infinity", wantError: true},
+		{value: "0x1p-2", wantError: true},
+		{value: "1_000", wantError: true},
+		{value: "1e", wantError: true},
+		{value: ".", wantError: true},
+		{value: "1.2.3", wantError: true},
+		{value: "1e400", wantError: true},
+		{value: "one", wantError: true},
+		{value: "1 2 bar 3", wantError: true},
+		{value: "1 2 3", wantError: true},
+		{value: "nan", openMetrics: true, wantValue: math.NaN()},
+		{value: "NaN", openMetrics: true, wantValue: math.NaN()},
+		{value: "inf", openMetrics: true, wantValue: math.Inf(1)},
+		{value: "-Infinity", openMetrics: true, wantValue: math.Inf(-1)},
+		{value: "+inf", openMetrics: true, wantValue: math.Inf(1)},
+		{value: "-nan", openMetrics: true, wantError: true},
+		{value: "0x10", openMetrics: true, wantError: true},
+	}
+
+	for _, tc := range testcases {
+		data := "\n\nmetric " + tc.value + "\n"
+		scanner := NewScanner()
+		if tc.openMetrics {
+			data += "# EOF\n"
+			scanner = NewOpenMetricsScanner()
+		}
+		tokens, err := scanner.Scan(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parser := NewParser(tokens)
+		if tc.openMetrics {
+			parser = NewOpenMetricsParser(tokens)
+		}
+		samples, _, err := parser.Parse()
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for value %v", tc.value)
+			}
+			if !strings.Contains(err.Error(), "line 2") {
+				t.Fatalf("expected error in line 2, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for value %v: %v", tc.value, err)
+		}
+
+		got := samples[0].Value
+		if math.IsNaN(tc.wantValue) {
+			if !math.IsNaN(got) {
+				t.Fatalf("unexpected value, wanted NaN, got %v", got)
+			}
+			continue
+		}
+		if got != tc.wantValue {
+			t.Fatalf("unexpected value, wanted %v, got %v", tc.wantValue, got)
+		}
+	}
+}
+
+func Test_ParserMissingValue(t *testing.T) {
+	tokens, err := NewScanner().Scan("metric\nother 1\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = NewParser(tokens).Parse()
+	if err == nil || !strings.Contains(err.Error(), "line 0") {
+		t.Fatalf("expected missing value error in line 0, got %v", err)
+	}
+}
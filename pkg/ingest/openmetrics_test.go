@@ -0,0 +1,386 @@
+package ingest
+
+import (
+	"math"
+	"reflect"
+	"scrape/api"
+	"testing"
+)
+
+func parseOpenMetrics(data string) ([]api.Sample, []api.Family, error) {
+	scanner := NewOpenMetricsScanner()
+	tokens, err := scanner.Scan(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parser := NewOpenMetricsParser(tokens)
+	return parser.Parse()
+}
+
+func Test_OpenMetricsValid(t *testing.T) {
+	type testcase struct {
+		name         string
+		data         string
+		wantSamples  []api.Sample
+		wantFamilies []api.Family
+	}
+
+	testcases := []testcase{
+		{
+			name: "empty",
+			data: "# EOF\n",
+		},
+		{
+			name: "no trailing newline",
+			data: "# EOF",
+		},
+		{
+			name: "counter with unit and created",
+			data: `# TYPE request_seconds counter
+# UNIT request_seconds seconds
+# HELP request_seconds Time spent, in \"seconds\".
+request_seconds_total{path="/"} 17.5 1697000000.5
+request_seconds_created{path="/"} 1696000000
+# EOF
+`,
+			wantSamples: []api.Sample{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "request_seconds_total"},
+						{Name: "path", Value: "/"},
+					},
+					Value:     17.5,
+					Timestamp: api.Timestamp(1697000000500),
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "request_seconds_created"},
+						{Name: "path", Value: "/"},
+					},
+					Value: 1696000000,
+				},
+			},
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "request_seconds",
+						Type: api.MetricTypeCounter,
+						Help: `Time spent, in "seconds".`,
+						Unit: "seconds",
+					},
+				},
+			},
+		},
+		{
+			name: "exemplar",
+			data: `# TYPE requests counter
+requests_total 3 # {trace_id="abc"} 1.5 1697000000
+requests_total{code="500"} 1 # {} 2
+# EOF
+`,
+			wantSamples: []api.Sample{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "requests_total"},
+					},
+					Value: 3,
+					Exemplar: &api.Exemplar{
+						Labels: []api.Label{
+							{Name: "trace_id", Value: "abc"},
+						},
+						Value:     1.5,
+						Timestamp: 1697000000000,
+					},
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "requests_total"},
+						{Name: "code", Value: "500"},
+					},
+					Value: 1,
+					Exemplar: &api.Exemplar{
+						Value: 2,
+					},
+				},
+			},
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "requests",
+						Type: api.MetricTypeCounter,
+					},
+				},
+			},
+		},
+		{
+			name: "info and stateset",
+			data: `# TYPE build info
+build_info{version="1.0"} 1
+# TYPE state stateset
+state{state="ready"} 1
+state{state="failed"} 0
+# EOF
+`,
+			wantSamples: []api.Sample{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "build_info"},
+						{Name: "version", Value: "1.0"},
+					},
+					Value: 1,
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "state"},
+						{Name: "state", Value: "ready"},
+					},
+					Value: 1,
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "state"},
+						{Name: "state", Value: "failed"},
+					},
+					Value: 0,
+				},
+			},
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "build",
+						Type: api.MetricTypeInfo,
+					},
+				},
+				{
+					Metadata: api.Metadata{
+						Name: "state",
+						Type: api.MetricTypeStateSet,
+					},
+				},
+			},
+		},
+		{
+			name: "histogram with created and exemplar",
+			data: `# TYPE latency histogram
+latency_bucket{le="1"} 1 # {trace_id="abc"} 0.5
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+latency_created 1696000000
+# EOF
+`,
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "latency",
+						Type: api.MetricTypeHistogram,
+					},
+					Histograms: []api.Histogram{
+						{
+							Labels: []api.Label{
+								{Name: "__name__", Value: "latency"},
+							},
+							Buckets: []api.Bucket{
+								{UpperBound: 1, Count: 1},
+								{UpperBound: math.Inf(1), Count: 2},
+							},
+							Sum:     3,
+							Count:   2,
+							Created: 1696000000,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "gauge histogram",
+			data: `# TYPE queue gaugehistogram
+queue_bucket{le="1"} 2 # {trace_id="abc"} 0.5
+queue_bucket{le="+Inf"} 3
+queue_gsum 4
+queue_gcount 3
+# EOF
+`,
+			wantSamples: []api.Sample{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "queue_bucket"},
+						{Name: "le", Value: "1"},
+					},
+					Value: 2,
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "queue_bucket"},
+						{Name: "le", Value: "+Inf"},
+					},
+					Value: 3,
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "queue_gsum"},
+					},
+					Value: 4,
+				},
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "queue_gcount"},
+					},
+					Value: 3,
+				},
+			},
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "queue",
+						Type: api.MetricTypeGaugeHistogram,
+					},
+				},
+			},
+		},
+		{
+			name: "unknown type by default",
+			data: `# HELP thing A thing.
+thing 1
+# EOF
+`,
+			wantSamples: []api.Sample{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "thing"},
+					},
+					Value: 1,
+				},
+			},
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "thing",
+						Type: api.MetricTypeUnknown,
+						Help: "A thing.",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		samples, families, err := parseOpenMetrics(tc.data)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.name, err)
+		}
+
+		if !reflect.DeepEqual(tc.wantSamples, samples) {
+			t.Fatalf("%v: unexpected samples, wanted %v, got %v", tc.name, tc.wantSamples, samples)
+		}
+		if !reflect.DeepEqual(tc.wantFamilies, families) {
+			t.Fatalf("%v: unexpected families, wanted %v, got %v", tc.name, tc.wantFamilies, families)
+		}
+	}
+}
+
+func Test_OpenMetricsInvalid(t *testing.T) {
+	type testcase struct {
+		name string
+		data string
+	}
+
+	testcases := []testcase{
+		{
+			name: "missing eof",
+			data: "metric 1\n",
+		},
+		{
+			name: "content after eof",
+			data: "# EOF\nmetric 1\n",
+		},
+		{
+			name: "plain comment",
+			data: "# a comment\n# EOF\n",
+		},
+		{
+			name: "untyped is not a valid type",
+			data: "# TYPE metric untyped\n# EOF\n",
+		},
+		{
+			name: "unit is not a suffix",
+			data: "# TYPE metric gauge\n# UNIT metric seconds\n# EOF\n",
+		},
+		{
+			name: "negative counter",
+			data: "# TYPE metric counter\nmetric_total -1\n# EOF\n",
+		},
+		{
+			name: "info value other than one",
+			data: "# TYPE build info\nbuild_info 2\n# EOF\n",
+		},
+		{
+			name: "stateset without state label",
+			data: "# TYPE state stateset\nstate 1\n# EOF\n",
+		},
+		{
+			name: "stateset value other than zero or one",
+			data: "# TYPE state stateset\nstate{state=\"a\"} 2\n# EOF\n",
+		},
+		{
+			name: "invalid exemplar",
+			data: "# TYPE metric counter\nmetric_total 1 # trace_id=\"abc\" 1\n# EOF\n",
+		},
+		{
+			name: "exemplar labels too long",
+			data: "metric_total 1 # {trace_id=\"0123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789\"} 1\n# EOF\n",
+		},
+		{
+			name: "gauge histogram without +Inf bucket",
+			data: "# TYPE queue gaugehistogram\nqueue_bucket{le=\"1\"} 2\nqueue_gsum 4\nqueue_gcount 2\n# EOF\n",
+		},
+		{
+			name: "gauge histogram with non-monotonic buckets",
+			data: "# TYPE queue gaugehistogram\nqueue_bucket{le=\"1\"} 3\nqueue_bucket{le=\"+Inf\"} 2\n# EOF\n",
+		},
+		{
+			name: "gauge histogram count not matching the +Inf bucket",
+			data: "# TYPE queue gaugehistogram\nqueue_bucket{le=\"+Inf\"} 2\nqueue_gcount 3\n# EOF\n",
+		},
+		{
+			name: "gauge histogram bucket without le",
+			data: "# TYPE queue gaugehistogram\nqueue_bucket 2\n# EOF\n",
+		},
+		{
+			name: "counter created without total",
+			data: "# TYPE requests counter\nrequests_created 1696000000\n# EOF\n",
+		},
+		{
+			name: "counter created of another series",
+			data: "# TYPE requests counter\nrequests_total{code=\"200\"} 1\nrequests_created{code=\"500\"} 1696000000\n# EOF\n",
+		},
+		{
+			name: "exemplar on a gauge",
+			data: "# TYPE temperature gauge\ntemperature 21 # {trace_id=\"abc\"} 1\n# EOF\n",
+		},
+		{
+			name: "exemplar on a counter created series",
+			data: "# TYPE requests counter\nrequests_total 1\nrequests_created 1696000000 # {trace_id=\"abc\"} 1\n# EOF\n",
+		},
+		{
+			name: "exemplar on a histogram sum",
+			data: "# TYPE latency histogram\nlatency_bucket{le=\"+Inf\"} 2\nlatency_sum 3 # {trace_id=\"abc\"} 1\n# EOF\n",
+		},
+		{
+			name: "exemplar without a family",
+			data: "metric 1 # {trace_id=\"abc\"} 1\n# EOF\n",
+		},
+		{
+			name: "invalid timestamp",
+			data: "metric 1 yesterday\n# EOF\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		_, _, err := parseOpenMetrics(tc.data)
+		if err == nil {
+			t.Fatalf("%v: expected error", tc.name)
+		}
+	}
+}
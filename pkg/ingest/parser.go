@@ -3,20 +3,90 @@ package ingest
 import (
 	"errors"
 	"fmt"
+	"math"
 	"scrape/api"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // Parser parses metrics responses in Prometheus format
 type Parser struct {
-	index  int
-	tokens TokenList
+	index       int
+	tokens      TokenList
+	metadata    map[string]*api.Metadata
+	families    []string
+	typed       map[string]bool
+	openMetrics bool
+	eof         bool
+	lenient     bool
+	diagnostics []Diagnostic
 }
 
 func NewParser(tokens TokenList) *Parser {
 	return &Parser{
-		index:  0,
-		tokens: tokens,
+		index:    0,
+		tokens:   tokens,
+		metadata: map[string]*api.Metadata{},
+		typed:    map[string]bool{},
+	}
+}
+
+// NewOpenMetricsParser creates a parser for tokens produced by the OpenMetrics
+// scanner
+func NewOpenMetricsParser(tokens TokenList) *Parser {
+	p := NewParser(tokens)
+	p.openMetrics = true
+	return p
+}
+
+// SetLenient makes the parser skip malformed lines instead of failing, the
+// skipped lines are reported by Diagnostics
+func (p *Parser) SetLenient(lenient bool) {
+	p.lenient = lenient
+}
+
+func (p *Parser) Diagnostics() []Diagnostic {
+	return p.diagnostics
+}
+
+// diagnose returns err in strict mode, in lenient mode the error is recorded
+// and nil returned
+func (p *Parser) diagnose(line int, token string, err error) error {
+	if !p.lenient {
+		return err
+	}
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Line:   line,
+		Token:  token,
+		Reason: err.Error(),
+	})
+	return nil
+}
+
+func unexpected(t *Token) error {
+	return errors.New(fmt.Sprintf("unexpected token %v in line %v", describeToken(t), t.Line))
+}
+
+// current returns the last token read or nil at the start of the stream
+func (p *Parser) current() *Token {
+	if p.index == 0 {
+		return p.tokens.at(0)
+	}
+	return p.tokens.at(p.index - 1)
+}
+
+func (p *Parser) lastLine() int {
+	if len(p.tokens) == 0 {
+		return 0
+	}
+	return p.tokens[len(p.tokens)-1].Line
+}
+
+// skipLine skips the remaining tokens of the given line
+func (p *Parser) skipLine(line int) {
+	for p.hasTokens() && p.tokens.at(p.index).Line <= line {
+		p.consume()
 	}
 }
 
@@ -57,56 +127,55 @@ func (p *Parser) expect(t TokenType) (*Token, error) {
 	return nil, errors.New(fmt.Sprintf("unexpected token, expected %v but got %v:%v in line %v", TokenMapping[t], TokenMapping[token.TokenType], token.StringVal, token.Line))
 }
 
-func (p *Parser) label() (*api.Label, error) {
-	label := &api.Label{}
-
+func (p *Parser) label() (api.Label, error) {
 	name, err := p.expect(TokenTypeName)
 	if err != nil {
-		return label, err
+		return api.Label{}, err
 	}
 
 	_, err = p.expect(TokenTypeEquals)
 	if err != nil {
-		return label, err
+		return api.Label{}, err
 	}
 
 	_, err = p.expect(TokenTypeQuote)
 	if err != nil {
-		return label, err
+		return api.Label{}, err
 	}
 
-	la, err := p.peek()
+	value, err := p.expect(TokenTypeName)
 	if err != nil {
-		return label, err
-	}
-
-	labelValue := ""
-	if la.TokenType != TokenTypeQuote {
-		value, err := p.expect(TokenTypeName)
-		if err != nil {
-			return label, err
-		}
-		labelValue = value.StringVal
+		return api.Label{}, err
 	}
 
 	_, err = p.expect(TokenTypeQuote)
 	if err != nil {
-		return label, err
+		return api.Label{}, err
 	}
 
-	label.Name = name.StringVal
-	label.Value = labelValue
-	return label, nil
+	return api.Label{
+		Name:  name.StringVal,
+		Value: value.StringVal,
+	}, nil
 }
 
-func (p *Parser) labels() ([]api.Label, error) {
-	var labels []api.Label
+// labels parses a label list and appends the labels to the given ones
+func (p *Parser) labels(labels []api.Label) ([]api.Label, error) {
+	// empty label set
+	la, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if la.TokenType == TokenTypeRBrace {
+		return labels, nil
+	}
+
 	for p.hasTokens() {
 		label, err := p.label()
 		if err != nil {
 			return nil, err
 		}
-		labels = append(labels, *label)
+		labels = append(labels, label)
 
 		la, err := p.peek()
 		if err != nil {
@@ -146,47 +215,302 @@ func (p *Parser) timeseries() (*api.Sample, error) {
 	if la.TokenType == TokenTypeLBrace {
 		// label list
 		p.consume()
-		labels, err := p.labels()
+		sample.Labels, err = p.labels(sample.Labels)
 		if err != nil {
 			return nil, err
 		}
-		sample.Labels = append(sample.Labels, labels...)
 		_, err = p.expect(TokenTypeRBrace)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// sample value
+	// sample value, which has to be on the same line
+	la, err = p.peek()
+	if err != nil {
+		return sample, err
+	}
+	if la.Line != token.Line {
+		return sample, errors.New(fmt.Sprintf("missing value for %v in line %v", token.StringVal, token.Line))
+	}
+
 	sampleValue, err := p.expect(TokenTypeName)
 	if err != nil {
 		return sample, err
 	}
 
-	var parsedValue = 0.0
-	if sampleValue.StringVal != "" {
-		parsedValue, err = strconv.ParseFloat(sampleValue.StringVal, 64)
+	parsedValue, ok := parseNumber(sampleValue.StringVal, p.openMetrics)
+	if !ok {
+		return sample, errors.New(fmt.Sprintf("invalid value %q in line %v", sampleValue.StringVal, sampleValue.Line))
+	}
+
+	sample.Value = parsedValue
+
+	// optional timestamp, only if it is on the same line as the value
+	timestamp, err := p.timestamp(sampleValue.Line)
+	if err != nil {
+		return sample, err
+	}
+	sample.Timestamp = timestamp
+
+	// optional exemplar
+	if p.openMetrics && p.hasTokens() {
+		la, err = p.peek()
 		if err != nil {
 			return sample, err
 		}
+		if la.TokenType == TokenTypeHash && la.Line == sampleValue.Line {
+			p.consume()
+			exemplar, err := p.exemplar()
+			if err != nil {
+				return sample, err
+			}
+			sample.Exemplar = exemplar
+		}
 	}
 
-	sample.Value = parsedValue
-
 	return sample, nil
 }
 
-func (p *Parser) Parse() ([]api.Sample, error) {
+// timestamp parses the optional timestamp following a value in the given line,
+// nil if there is none. Prometheus uses milliseconds while OpenMetrics uses
+// seconds.
+func (p *Parser) timestamp(line int) (*int64, error) {
+	if !p.hasTokens() {
+		return nil, nil
+	}
+	la, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if la.TokenType != TokenTypeName || la.Line != line {
+		return nil, nil
+	}
+	p.consume()
+
+	if p.openMetrics {
+		seconds, ok := parseNumber(la.StringVal, p.openMetrics)
+		if !ok || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return nil, errors.New(fmt.Sprintf("invalid timestamp %v in line %v", la.StringVal, la.Line))
+		}
+		return api.Timestamp(int64(math.Round(seconds * 1000))), nil
+	}
+
+	timestamp, err := strconv.ParseInt(la.StringVal, 10, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid timestamp %v in line %v", la.StringVal, la.Line))
+	}
+	return &timestamp, nil
+}
+
+func (p *Parser) exemplar() (*api.Exemplar, error) {
+	// # {<label>="<value>", ...} <value> [<timestamp>]
+	exemplar := &api.Exemplar{}
+	brace, err := p.expect(TokenTypeLBrace)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := p.labels(nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(TokenTypeRBrace)
+	if err != nil {
+		return nil, err
+	}
+
+	// the combined length of the label names and values must not exceed 128
+	length := 0
+	for _, label := range labels {
+		length += utf8.RuneCountInString(label.Name) + utf8.RuneCountInString(label.Value)
+	}
+	if length > 128 {
+		return nil, errors.New(fmt.Sprintf("exemplar labels exceed 128 characters in line %v", brace.Line))
+	}
+	exemplar.Labels = labels
+
+	value, err := p.expect(TokenTypeName)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	exemplar.Value, ok = parseNumber(value.StringVal, p.openMetrics)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("invalid exemplar value %q in line %v", value.StringVal, value.Line))
+	}
+
+	timestamp, err := p.timestamp(value.Line)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp != nil {
+		exemplar.Timestamp = *timestamp
+	}
+
+	return exemplar, nil
+}
+
+func (p *Parser) family(name string) *api.Metadata {
+	if m, ok := p.metadata[name]; ok {
+		return m
+	}
+	m := &api.Metadata{
+		Name: name,
+		Type: api.MetricTypeUntyped,
+	}
+	if p.openMetrics {
+		m.Type = api.MetricTypeUnknown
+	}
+	p.metadata[name] = m
+	p.families = append(p.families, name)
+	return m
+}
+
+func (p *Parser) metricType(t *Token) (api.MetricType, error) {
+	metricType := api.MetricType(t.StringVal)
+	switch metricType {
+	case api.MetricTypeCounter, api.MetricTypeGauge, api.MetricTypeHistogram, api.MetricTypeSummary:
+		return metricType, nil
+	case api.MetricTypeUntyped:
+		if !p.openMetrics {
+			return metricType, nil
+		}
+	case api.MetricTypeGaugeHistogram, api.MetricTypeInfo, api.MetricTypeStateSet, api.MetricTypeUnknown:
+		if p.openMetrics {
+			return metricType, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("unknown metric type %v in line %v", t.StringVal, t.Line))
+}
+
+func (p *Parser) metadataLine() error {
+	// # HELP <metric> <text>
+	// # TYPE <metric> <type>
+	// # UNIT <metric> <unit>
+	keyword, err := p.next()
+	if err != nil {
+		return err
+	}
+
+	name, err := p.expect(TokenTypeName)
+	if err != nil {
+		return err
+	}
+	if name.StringVal == "" {
+		return errors.New(fmt.Sprintf("missing metric name in %v line %v", TokenMapping[keyword.TokenType], keyword.Line))
+	}
+
+	text, err := p.expect(TokenTypeText)
+	if err != nil {
+		return err
+	}
+
+	m := p.family(name.StringVal)
+	if keyword.TokenType == TokenTypeHelp {
+		m.Help = text.StringVal
+		return nil
+	}
+
+	if keyword.TokenType == TokenTypeUnit {
+		// the unit must be a suffix of the metric name
+		if text.StringVal != "" && !strings.HasSuffix(name.StringVal, "_"+text.StringVal) {
+			return errors.New(fmt.Sprintf("unit %v is not a suffix of metric %v in line %v", text.StringVal, name.StringVal, keyword.Line))
+		}
+		m.Unit = text.StringVal
+		return nil
+	}
+
+	if p.typed[name.StringVal] {
+		return errors.New(fmt.Sprintf("duplicate TYPE for metric %v in line %v", name.StringVal, keyword.Line))
+	}
+	metricType, err := p.metricType(text)
+	if err != nil {
+		return err
+	}
+	m.Type = metricType
+	p.typed[name.StringVal] = true
+	return nil
+}
+
+// statement parses a metadata line or a sample, the sample is nil for all lines
+// other than samples
+func (p *Parser) statement() (*api.Sample, error) {
+	la, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.eof {
+		return nil, errors.New(fmt.Sprintf("unexpected content after # EOF in line %v", la.Line))
+	}
+
+	switch la.TokenType {
+	case TokenTypeEOF:
+		p.consume()
+		p.eof = true
+		return nil, nil
+	case TokenTypeHelp, TokenTypeType, TokenTypeUnit:
+		return nil, p.metadataLine()
+	default:
+		return p.timeseries()
+	}
+}
+
+// finish checks that the input was complete
+func (p *Parser) finish() error {
+	if p.openMetrics && !p.eof {
+		return errors.New("missing # EOF")
+	}
+	return nil
+}
+
+// Parse returns the parsed samples and every metric family that was announced
+// by a HELP or TYPE line. The series of histograms and summaries are grouped
+// into their families and not returned as individual samples.
+func (p *Parser) Parse() ([]api.Sample, []api.Family, error) {
 	var samples []api.Sample
+	var lines []int
 
 	for p.hasTokens() {
-		sample, err := p.timeseries()
+		line := p.tokens.at(p.index).Line
+		sample, err := p.statement()
+		// every statement has to end with its line
+		if err == nil && p.hasTokens() && p.tokens.at(p.index).Line == line {
+			p.consume()
+			err = unexpected(p.current())
+		}
 		if err != nil {
-			return nil, err
+			token := ""
+			if current := p.current(); current.Line == line {
+				token = describeToken(current)
+			}
+			err = p.diagnose(line, token, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.skipLine(line)
+			continue
+		}
+
+		if sample != nil {
+			samples = append(samples, *sample)
+			lines = append(lines, line)
 		}
+	}
+
+	err := p.finish()
+	if err != nil {
+		err = p.diagnose(p.lastLine(), "", err)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-		samples = append(samples, *sample)
+	var metadata []api.Metadata
+	for _, name := range p.families {
+		metadata = append(metadata, *p.metadata[name])
 	}
 
-	return samples, nil
+	return groupFamilies(samples, lines, metadata, p.diagnose)
 }
@@ -1,6 +1,12 @@
 package ingest
 
-import "testing"
+import (
+	"math"
+	"reflect"
+	"scrape/api"
+	"strings"
+	"testing"
+)
 
 func Test_Parser(t *testing.T) {
 	timeseries := `
@@ -20,8 +26,473 @@ up{pod="a"} 1.0
 	}
 
 	parser := NewParser(tokens)
-	_, err = parser.Parse()
+	_, _, err = parser.Parse()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func Test_ParserMetadata(t *testing.T) {
+	type testcase struct {
+		data         string
+		wantError    bool
+		wantMetadata []api.Metadata
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 1027
+# TYPE temperature gauge
+temperature 21.5
+# a comment
+`,
+			wantError: false,
+			wantMetadata: []api.Metadata{
+				{
+					Name: "http_requests_total",
+					Type: api.MetricTypeCounter,
+					Help: "The total number of requests.",
+				},
+				{
+					Name: "temperature",
+					Type: api.MetricTypeGauge,
+				},
+			},
+		},
+		{
+			data: `
+# HELP latency Request latency.
+latency 1.0
+`,
+			wantError: false,
+			wantMetadata: []api.Metadata{
+				{
+					Name: "latency",
+					Type: api.MetricTypeUntyped,
+					Help: "Request latency.",
+				},
+			},
+		},
+		{
+			data: `
+# TYPE latency timer
+latency 1.0
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE latency gauge
+# TYPE latency counter
+latency 1.0
+`,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		scanner := NewScanner()
+		tokens, err := scanner.Scan(tc.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parser := NewParser(tokens)
+		_, families, err := parser.Parse()
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var metadata []api.Metadata
+		for _, family := range families {
+			metadata = append(metadata, family.Metadata)
+		}
+		if !reflect.DeepEqual(tc.wantMetadata, metadata) {
+			t.Fatalf("unexpected result, wanted %v, got %v", tc.wantMetadata, metadata)
+		}
+	}
+}
+
+func Test_ParserTimestamp(t *testing.T) {
+	type testcase struct {
+		data           string
+		wantError      bool
+		wantTimestamps []*int64
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+metric{a="b"} 1.0 1697000000000
+metric{a="c"} 2.0
+metric{a="d"} 3.0 0
+metric 4.0 -1000
+`,
+			wantError:      false,
+			wantTimestamps: []*int64{api.Timestamp(1697000000000), nil, api.Timestamp(0), api.Timestamp(-1000)},
+		},
+		{
+			data: `
+metric 1.0 tomorrow
+`,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		scanner := NewScanner()
+		tokens, err := scanner.Scan(tc.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parser := NewParser(tokens)
+		samples, _, err := parser.Parse()
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var timestamps []*int64
+		for _, sample := range samples {
+			timestamps = append(timestamps, sample.Timestamp)
+		}
+		if !reflect.DeepEqual(tc.wantTimestamps, timestamps) {
+			t.Fatalf("unexpected result, wanted %v, got %v", tc.wantTimestamps, timestamps)
+		}
+	}
+}
+
+func Test_ParserLabelEscaping(t *testing.T) {
+	type testcase struct {
+		data       string
+		wantLabels []api.Label
+	}
+
+	testcases := []testcase{
+		{
+			data: `metric{a=""} 1.0`,
+			wantLabels: []api.Label{
+				{Name: "__name__", Value: "metric"},
+				{Name: "a", Value: ""},
+			},
+		},
+		{
+			data: `metric{a="\"quoted\"",b="back\\slash",c="new\nline"} 1.0`,
+			wantLabels: []api.Label{
+				{Name: "__name__", Value: "metric"},
+				{Name: "a", Value: `"quoted"`},
+				{Name: "b", Value: `back\slash`},
+				{Name: "c", Value: "new\nline"},
+			},
+		},
+		{
+			data: `metric{path="/a,b",query="{x=y}",trailing="\\"} 1.0`,
+			wantLabels: []api.Label{
+				{Name: "__name__", Value: "metric"},
+				{Name: "path", Value: "/a,b"},
+				{Name: "query", Value: "{x=y}"},
+				{Name: "trailing", Value: `\`},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		scanner := NewScanner()
+		tokens, err := scanner.Scan(tc.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parser := NewParser(tokens)
+		samples, _, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(samples) != 1 {
+			t.Fatalf("unexpected number of samples, wanted 1, got %v", len(samples))
+		}
+		if !reflect.DeepEqual(tc.wantLabels, samples[0].Labels) {
+			t.Fatalf("unexpected result, wanted %v, got %v", tc.wantLabels, samples[0].Labels)
+		}
+	}
+}
+
+func Test_ParserFamilies(t *testing.T) {
+	type testcase struct {
+		data         string
+		wantError    bool
+		wantSamples  int
+		wantFamilies []api.Family
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{path="/",le="0.1"} 2
+request_duration_seconds_bucket{path="/",le="1"} 5
+request_duration_seconds_bucket{path="/",le="+Inf"} 6
+request_duration_seconds_sum{path="/"} 3.5
+request_duration_seconds_count{path="/"} 6
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.99"} 0.9
+rpc_duration_seconds{quantile="0.5"} 0.2
+rpc_duration_seconds_sum 12
+rpc_duration_seconds_count 40
+up 1
+`,
+			wantError:   false,
+			wantSamples: 1,
+			wantFamilies: []api.Family{
+				{
+					Metadata: api.Metadata{
+						Name: "request_duration_seconds",
+						Type: api.MetricTypeHistogram,
+					},
+					Histograms: []api.Histogram{
+						{
+							Labels: []api.Label{
+								{Name: "__name__", Value: "request_duration_seconds"},
+								{Name: "path", Value: "/"},
+							},
+							Buckets: []api.Bucket{
+								{UpperBound: 0.1, Count: 2},
+								{UpperBound: 1, Count: 5},
+								{UpperBound: math.Inf(1), Count: 6},
+							},
+							Sum:   3.5,
+							Count: 6,
+						},
+					},
+				},
+				{
+					Metadata: api.Metadata{
+						Name: "rpc_duration_seconds",
+						Type: api.MetricTypeSummary,
+					},
+					Summaries: []api.Summary{
+						{
+							Labels: []api.Label{
+								{Name: "__name__", Value: "rpc_duration_seconds"},
+							},
+							Quantiles: []api.Quantile{
+								{Quantile: 0.5, Value: 0.2},
+								{Quantile: 0.99, Value: 0.9},
+							},
+							Sum:   12,
+							Count: 40,
+						},
+					},
+				},
+			},
+		},
+		{
+			data: `
+# TYPE h histogram
+h_bucket{le="1"} 2
+h_sum 1
+h_count 2
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE h histogram
+h_bucket{le="1"} 5
+h_bucket{le="2"} 3
+h_bucket{le="+Inf"} 5
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE h histogram
+h_bucket{le="one"} 1
+h_bucket{le="+Inf"} 1
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE h histogram
+h_bucket 1
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE h histogram
+h_bucket{le="+Inf"} 3
+h_count 4
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE s summary
+s{quantile="1.5"} 1
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# TYPE s summary
+s 1
+`,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		scanner := NewScanner()
+		tokens, err := scanner.Scan(tc.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parser := NewParser(tokens)
+		samples, families, err := parser.Parse()
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(samples) != tc.wantSamples {
+			t.Fatalf("unexpected number of samples, wanted %v, got %v", tc.wantSamples, len(samples))
+		}
+		if !reflect.DeepEqual(tc.wantFamilies, families) {
+			t.Fatalf("unexpected result, wanted %v, got %v", tc.wantFamilies, families)
+		}
+	}
+}
+
+func Test_ParserLenient(t *testing.T) {
+	data := `up 1
+up{a="b" 1
+up{a="c"} 2 3 4
+# TYPE latency histogram
+latency_bucket{le="x"} 1
+latency_bucket{le="+Inf"} 1
+# TYPE state gauge
+# TYPE state gauge
+down 0
+`
+	wantDiagnostics := []Diagnostic{
+		{Line: 1, Token: `"`},
+		{Line: 2, Token: "4"},
+		{Line: 7, Token: "gauge"},
+		{Line: 4, Token: "latency_bucket"},
+	}
+
+	tokens, err := NewScanner().Scan(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// strict mode fails on the first malformed line
+	_, _, err = NewParser(tokens).Parse()
+	if err == nil {
+		t.Fatalf("expected error in strict mode")
+	}
+
+	parser := NewParser(tokens)
+	parser.SetLenient(true)
+	samples, families, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("unexpected number of samples, wanted 2, got %v", samples)
+	}
+	if len(families) != 2 || len(families[0].Histograms) != 1 {
+		t.Fatalf("unexpected families %v", families)
+	}
+
+	diagnostics := parser.Diagnostics()
+	if len(diagnostics) != len(wantDiagnostics) {
+		t.Fatalf("unexpected diagnostics, wanted %v, got %v", wantDiagnostics, diagnostics)
+	}
+	for i, want := range wantDiagnostics {
+		if diagnostics[i].Line != want.Line || diagnostics[i].Token != want.Token || diagnostics[i].Reason == "" {
+			t.Fatalf("unexpected diagnostic, wanted %v, got %v", want, diagnostics[i])
+		}
+	}
+}
+
+func Test_ParserLenientFamilies(t *testing.T) {
+	// only the histogram without a +Inf bucket is dropped
+	data := `# HELP foo Request latency.
+# TYPE foo histogram
+foo_bucket{a="1",le="1"} 1
+foo_bucket{a="1",le="+Inf"} 2
+foo_count{a="1"} 2
+foo_bucket{a="2",le="1"} 1
+foo_count{a="2"} 1
+up 1
+`
+	tokens, err := NewScanner().Scan(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parser := NewParser(tokens)
+	parser.SetLenient(true)
+	streamParser := NewStreamParser(strings.NewReader(data))
+	streamParser.SetLenient(true)
+
+	type testcase struct {
+		parse       func() ([]api.Sample, []api.Family, error)
+		diagnostics func() []Diagnostic
+	}
+
+	testcases := []testcase{
+		{parse: parser.Parse, diagnostics: parser.Diagnostics},
+		{
+			parse: func() ([]api.Sample, []api.Family, error) {
+				return stream(streamParser)
+			},
+			diagnostics: streamParser.Diagnostics,
+		},
+	}
+
+	for _, tc := range testcases {
+		samples, families, err := tc.parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(samples) != 1 {
+			t.Fatalf("unexpected samples %v", samples)
+		}
+		if len(families) != 1 || families[0].Help != "Request latency." || len(families[0].Histograms) != 1 {
+			t.Fatalf("unexpected families %v", families)
+		}
+		if families[0].Histograms[0].Labels[1] != (api.Label{Name: "a", Value: "1"}) {
+			t.Fatalf("unexpected histogram %v", families[0].Histograms[0])
+		}
+
+		diagnostics := tc.diagnostics()
+		if len(diagnostics) != 1 || diagnostics[0].Line != 5 || diagnostics[0].Token != "foo" {
+			t.Fatalf("unexpected diagnostics %v", diagnostics)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"scrape/api"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ProtobufParser parses metrics responses in the length delimited protobuf
+// format, a stream of io.prometheus.client.MetricFamily messages
+type ProtobufParser struct {
+	reader      *bufio.Reader
+	lenient     bool
+	diagnostics []Diagnostic
+}
+
+func NewProtobufParser(r io.Reader) *ProtobufParser {
+	return &ProtobufParser{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// SetLenient makes the parser skip invalid metric families instead of failing,
+// the skipped families are reported by Diagnostics with the index of the
+// message as line. A corrupt message always stops parsing.
+func (p *ProtobufParser) SetLenient(lenient bool) {
+	p.lenient = lenient
+}
+
+func (p *ProtobufParser) Diagnostics() []Diagnostic {
+	return p.diagnostics
+}
+
+func protobufLabels(name string, pairs []*dto.LabelPair) []api.Label {
+	labels := []api.Label{{Name: "__name__", Value: name}}
+	for _, pair := range pairs {
+		labels = append(labels, api.Label{
+			Name:  pair.GetName(),
+			Value: pair.GetValue(),
+		})
+	}
+	return labels
+}
+
+func protobufExemplar(e *dto.Exemplar) *api.Exemplar {
+	if e == nil {
+		return nil
+	}
+	exemplar := &api.Exemplar{
+		Value: e.GetValue(),
+	}
+	for _, pair := range e.GetLabel() {
+		exemplar.Labels = append(exemplar.Labels, api.Label{
+			Name:  pair.GetName(),
+			Value: pair.GetValue(),
+		})
+	}
+	if e.GetTimestamp() != nil {
+		exemplar.Timestamp = e.GetTimestamp().AsTime().UnixMilli()
+	}
+	return exemplar
+}
+
+// created converts the created timestamp to the seconds exposed by the
+// _created series of the text formats
+func created(t *timestamppb.Timestamp) float64 {
+	if t == nil {
+		return 0
+	}
+	return float64(t.AsTime().UnixNano()) / 1e9
+}
+
+func protobufMetricType(t dto.MetricType) api.MetricType {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return api.MetricTypeCounter
+	case dto.MetricType_GAUGE:
+		return api.MetricTypeGauge
+	case dto.MetricType_SUMMARY:
+		return api.MetricTypeSummary
+	case dto.MetricType_HISTOGRAM:
+		return api.MetricTypeHistogram
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		return api.MetricTypeGaugeHistogram
+	default:
+		return api.MetricTypeUntyped
+	}
+}
+
+// histogram validates the classic buckets of a histogram, native histogram
+// buckets are not supported and ignored
+func (p *ProtobufParser) histogram(b *familyBuilder, m *dto.Metric) (*api.Histogram, error) {
+	h := m.GetHistogram()
+	count := float64(h.GetSampleCount())
+	if h.GetSampleCountFloat() > 0 {
+		count = h.GetSampleCountFloat()
+	}
+
+	s := &familySeries{
+		labels:    protobufLabels(b.metadata.Name, m.GetLabel()),
+		timestamp: m.TimestampMs,
+		sum:       h.GetSampleSum(),
+		count:     count,
+		hasCount:  true,
+		created:   created(h.GetCreatedTimestamp()),
+	}
+	for _, bucket := range h.GetBucket() {
+		cumulative := float64(bucket.GetCumulativeCount())
+		if bucket.GetCumulativeCountFloat() > 0 {
+			cumulative = bucket.GetCumulativeCountFloat()
+		}
+		s.buckets = append(s.buckets, api.Bucket{
+			UpperBound: bucket.GetUpperBound(),
+			Count:      cumulative,
+		})
+	}
+
+	// the +Inf bucket is implicit in the protobuf format
+	if len(s.buckets) == 0 || !math.IsInf(s.buckets[len(s.buckets)-1].UpperBound, 1) {
+		s.buckets = append(s.buckets, api.Bucket{
+			UpperBound: math.Inf(1),
+			Count:      count,
+		})
+	}
+
+	return b.histogram(s)
+}
+
+func (p *ProtobufParser) summary(b *familyBuilder, m *dto.Metric) *api.Summary {
+	summary := m.GetSummary()
+	s := &familySeries{
+		labels:    protobufLabels(b.metadata.Name, m.GetLabel()),
+		timestamp: m.TimestampMs,
+		sum:       summary.GetSampleSum(),
+		count:     float64(summary.GetSampleCount()),
+		created:   created(summary.GetCreatedTimestamp()),
+	}
+	for _, q := range summary.GetQuantile() {
+		s.quantiles = append(s.quantiles, api.Quantile{
+			Quantile: q.GetQuantile(),
+			Value:    q.GetValue(),
+		})
+	}
+	return b.summary(s)
+}
+
+// gaugeHistogram flattens a gauge histogram into its _bucket, _gsum and
+// _gcount series
+func (p *ProtobufParser) gaugeHistogram(b *familyBuilder, m *dto.Metric) ([]api.Sample, error) {
+	h, err := p.histogram(b, m)
+	if err != nil {
+		return nil, err
+	}
+	return h.GaugeSamples(b.metadata.Name), nil
+}
+
+func (p *ProtobufParser) family(mf *dto.MetricFamily) ([]api.Sample, *api.Family, error) {
+	b := newFamilyBuilder(api.Metadata{
+		Name: mf.GetName(),
+		Type: protobufMetricType(mf.GetType()),
+		Help: mf.GetHelp(),
+		Unit: mf.GetUnit(),
+	})
+	family := &api.Family{
+		Metadata: b.metadata,
+	}
+
+	var samples []api.Sample
+	for _, m := range mf.GetMetric() {
+		sample := api.Sample{
+			Labels:    protobufLabels(mf.GetName(), m.GetLabel()),
+			Timestamp: m.TimestampMs,
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			sample.Value = m.GetCounter().GetValue()
+			sample.Exemplar = protobufExemplar(m.GetCounter().GetExemplar())
+			samples = append(samples, sample)
+			if c := created(m.GetCounter().GetCreatedTimestamp()); c != 0 {
+				samples = append(samples, api.Sample{
+					Labels:    protobufLabels(strings.TrimSuffix(mf.GetName(), "_total")+"_created", m.GetLabel()),
+					Value:     c,
+					Timestamp: m.TimestampMs,
+				})
+			}
+		case dto.MetricType_GAUGE:
+			sample.Value = m.GetGauge().GetValue()
+			samples = append(samples, sample)
+		case dto.MetricType_UNTYPED:
+			sample.Value = m.GetUntyped().GetValue()
+			samples = append(samples, sample)
+		case dto.MetricType_SUMMARY:
+			family.Summaries = append(family.Summaries, *p.summary(b, m))
+		case dto.MetricType_HISTOGRAM:
+			h, err := p.histogram(b, m)
+			if err != nil {
+				return nil, nil, err
+			}
+			family.Histograms = append(family.Histograms, *h)
+		case dto.MetricType_GAUGE_HISTOGRAM:
+			gauges, err := p.gaugeHistogram(b, m)
+			if err != nil {
+				return nil, nil, err
+			}
+			samples = append(samples, gauges...)
+		default:
+			return nil, nil, errors.New(fmt.Sprintf("unknown metric type %v of metric %v", mf.GetType(), mf.GetName()))
+		}
+	}
+
+	return samples, family, nil
+}
+
+// Stream reads one metric family at a time and hands out its samples and the
+// family itself, parsing stops at the first error
+func (p *ProtobufParser) Stream(onSample func(api.Sample) error, onFamily func(api.Family) error) error {
+	for message := 0; ; message++ {
+		mf := &dto.MetricFamily{}
+		err := protodelim.UnmarshalFrom(p.reader, mf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if mf.GetName() == "" {
+			err = errors.New("metric family without name")
+		}
+
+		var samples []api.Sample
+		var family *api.Family
+		if err == nil {
+			samples, family, err = p.family(mf)
+		}
+		if err != nil {
+			if !p.lenient {
+				return err
+			}
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Line:   message,
+				Token:  mf.GetName(),
+				Reason: err.Error(),
+			})
+			continue
+		}
+		for _, sample := range samples {
+			err = onSample(sample)
+			if err != nil {
+				return err
+			}
+		}
+		err = onFamily(*family)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Parse returns the parsed samples and families in the same shape as the text
+// parser, histograms and summaries are grouped into their families
+func (p *ProtobufParser) Parse() ([]api.Sample, []api.Family, error) {
+	var samples []api.Sample
+	var families []api.Family
+
+	err := p.Stream(func(sample api.Sample) error {
+		samples = append(samples, sample)
+		return nil
+	}, func(family api.Family) error {
+		families = append(families, family)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return samples, families, nil
+}
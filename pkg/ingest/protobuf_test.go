@@ -0,0 +1,183 @@
+package ingest
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"scrape/api"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func marshalFamilies(t *testing.T, families ...*dto.MetricFamily) []byte {
+	buf := &bytes.Buffer{}
+	for _, mf := range families {
+		_, err := protodelim.MarshalTo(buf, mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func Test_ProtobufParser(t *testing.T) {
+	data := marshalFamilies(t,
+		&dto.MetricFamily{
+			Name: proto.String("http_requests_total"),
+			Help: proto.String("The total number of requests."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("code"), Value: proto.String("200")},
+					},
+					Counter:     &dto.Counter{Value: proto.Float64(0.1 + 0.2)},
+					TimestampMs: proto.Int64(1697000000000),
+				},
+			},
+		},
+		&dto.MetricFamily{
+			Name: proto.String("latency_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(1.25),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)},
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+						},
+					},
+				},
+			},
+		},
+		&dto.MetricFamily{
+			Name: proto.String("rpc_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(10),
+						SampleSum:   proto.Float64(2),
+						Quantile: []*dto.Quantile{
+							{Quantile: proto.Float64(0.5), Value: proto.Float64(0.1)},
+						},
+					},
+				},
+			},
+		},
+	)
+
+	samples, families, err := NewProtobufParser(bytes.NewReader(data)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantSamples := []api.Sample{
+		{
+			Labels: []api.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "200"},
+			},
+			Value:     0.1 + 0.2,
+			Timestamp: api.Timestamp(1697000000000),
+		},
+	}
+	if !reflect.DeepEqual(wantSamples, samples) {
+		t.Fatalf("unexpected samples, wanted %v, got %v", wantSamples, samples)
+	}
+
+	wantFamilies := []api.Family{
+		{
+			Metadata: api.Metadata{
+				Name: "http_requests_total",
+				Type: api.MetricTypeCounter,
+				Help: "The total number of requests.",
+			},
+		},
+		{
+			Metadata: api.Metadata{
+				Name: "latency_seconds",
+				Type: api.MetricTypeHistogram,
+			},
+			Histograms: []api.Histogram{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "latency_seconds"},
+					},
+					Buckets: []api.Bucket{
+						{UpperBound: 0.5, Count: 1},
+						{UpperBound: 1, Count: 2},
+						{UpperBound: math.Inf(1), Count: 3},
+					},
+					Sum:   1.25,
+					Count: 3,
+				},
+			},
+		},
+		{
+			Metadata: api.Metadata{
+				Name: "rpc_seconds",
+				Type: api.MetricTypeSummary,
+			},
+			Summaries: []api.Summary{
+				{
+					Labels: []api.Label{
+						{Name: "__name__", Value: "rpc_seconds"},
+					},
+					Quantiles: []api.Quantile{
+						{Quantile: 0.5, Value: 0.1},
+					},
+					Sum:   2,
+					Count: 10,
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(wantFamilies, families) {
+		t.Fatalf("unexpected families, wanted %v, got %v", wantFamilies, families)
+	}
+}
+
+func Test_ProtobufParserInvalid(t *testing.T) {
+	type testcase struct {
+		name string
+		data []byte
+	}
+
+	testcases := []testcase{
+		{
+			name: "truncated message",
+			data: marshalFamilies(t, &dto.MetricFamily{Name: proto.String("up")})[:2],
+		},
+		{
+			name: "non-monotonic buckets",
+			data: marshalFamilies(t, &dto.MetricFamily{
+				Name: proto.String("latency_seconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)},
+								{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+							},
+						},
+					},
+				},
+			}),
+		},
+	}
+
+	for _, tc := range testcases {
+		_, _, err := NewProtobufParser(bytes.NewReader(tc.data)).Parse()
+		if err == nil {
+			t.Fatalf("%v: expected error", tc.name)
+		}
+	}
+}
@@ -1,61 +1,194 @@
 package ingest
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type Scanner struct {
+	openMetrics bool
 }
 
 func NewScanner() *Scanner {
 	return &Scanner{}
 }
 
-func (*Scanner) Scan(data string) (TokenList, error) {
-	var tokens TokenList
-	runes := []rune(data)
+// NewOpenMetricsScanner creates a scanner for the OpenMetrics text format,
+// which adds UNIT and EOF lines and exemplars to the Prometheus format
+func NewOpenMetricsScanner() *Scanner {
+	return &Scanner{
+		openMetrics: true,
+	}
+}
+
+func (s *Scanner) Scan(data string) (TokenList, error) {
+	return s.scan(data, 0, nil)
+}
+
+// scan tokenizes data, counting lines from the given line number, and appends
+// the tokens to the given list. Names and values are slices of data unless
+// they contain escape sequences.
+func (s *Scanner) scan(data string, line int, tokens TokenList) (TokenList, error) {
 	index := 0
-	line := 0
-	quoted := false
 
 	next := func() rune {
-		current := runes[index]
-		index = index + 1
+		current, size := utf8.DecodeRuneInString(data[index:])
+		index = index + size
 		return current
 	}
 
 	peek := func() rune {
-		return runes[index]
+		current, _ := utf8.DecodeRuneInString(data[index:])
+		return current
 	}
 
-	name := func(t rune) Token {
+	// name scans a name starting at the given position
+	name := func(start int) Token {
+		for index < len(data) {
+			r := peek()
+			if r == '{' || r == '=' || r == ',' || unicode.IsSpace(r) {
+				break
+			}
+			next()
+		}
+
+		return Token{
+			TokenType: TokenTypeName,
+			StringVal: data[start:index],
+			Line:      line,
+		}
+	}
+
+	// escaped resolves the escape sequence following a backslash, label
+	// values may escape quotes, help texts only backslashes and line breaks
+	escaped := func(quotes bool) (rune, error) {
+		if index >= len(data) {
+			return 0, errors.New(fmt.Sprintf("unexpected end of stream after escape character in line %v", line))
+		}
+		r := next()
+		switch {
+		case r == '\\':
+			return '\\', nil
+		case r == 'n':
+			return '\n', nil
+		case r == '"' && quotes:
+			return '"', nil
+		default:
+			return 0, errors.New(fmt.Sprintf("invalid escape sequence \\%c in line %v", r, line))
+		}
+	}
+
+	// value scans a quoted label value up to the closing quote and
+	// resolves all escape sequences
+	value := func() (Token, error) {
+		start := index
 		sb := strings.Builder{}
-		sb.WriteRune(t)
-		for index < len(runes) {
+		escapes := false
+		for index < len(data) {
 			r := peek()
-			if quoted {
-				if r == '"' {
-					break
-				}
-			} else {
-				if r == '{' || r == '=' || r == ',' || unicode.IsSpace(r) {
-					break
+			if r == '"' {
+				break
+			}
+			if r == '\n' {
+				return Token{}, errors.New(fmt.Sprintf("unterminated label value in line %v", line))
+			}
+			if r == '\\' && !escapes {
+				sb.WriteString(data[start:index])
+				escapes = true
+			}
+			next()
+			if r == '\\' {
+				e, err := escaped(true)
+				if err != nil {
+					return Token{}, err
 				}
+				r = e
 			}
-
-			sb.WriteRune(next())
+			if escapes {
+				sb.WriteRune(r)
+			}
+		}
+		if index >= len(data) {
+			return Token{}, errors.New(fmt.Sprintf("unterminated label value in line %v", line))
 		}
 
+		val := data[start:index]
+		if escapes {
+			val = sb.String()
+		}
 		return Token{
 			TokenType: TokenTypeName,
-			StringVal: sb.String(),
+			StringVal: val,
 			Line:      line,
+		}, nil
+	}
+
+	// skip blanks without consuming the line break
+	blank := func() {
+		for index < len(data) && (data[index] == ' ' || data[index] == '\t') {
+			index = index + 1
+		}
+	}
+
+	word := func() string {
+		start := index
+		for index < len(data) && !unicode.IsSpace(peek()) {
+			next()
 		}
+		return data[start:index]
+	}
+
+	// metadata scans the remainder of a HELP or TYPE line: the metric
+	// name followed by free text up to the end of the line
+	metadata := func(t TokenType) error {
+		tokens = append(tokens, Token{
+			TokenType: t,
+			Line:      line,
+		})
+		blank()
+		tokens = append(tokens, Token{
+			TokenType: TokenTypeName,
+			StringVal: word(),
+			Line:      line,
+		})
+		blank()
+		start := index
+		sb := strings.Builder{}
+		escapes := false
+		for index < len(data) && data[index] != '\n' {
+			r := next()
+			if r == '\\' && t == TokenTypeHelp {
+				if !escapes {
+					sb.WriteString(data[start : index-1])
+					escapes = true
+				}
+				e, err := escaped(s.openMetrics)
+				if err != nil {
+					return err
+				}
+				r = e
+			}
+			if escapes {
+				sb.WriteRune(r)
+			}
+		}
+		text := data[start:index]
+		if escapes {
+			text = sb.String()
+		}
+		tokens = append(tokens, Token{
+			TokenType: TokenTypeText,
+			StringVal: strings.TrimRight(text, " \t\r"),
+			Line:      line,
+		})
+		return nil
 	}
 
 	comment := func() {
-		for index < len(runes) {
+		for index < len(data) {
 			if next() == '\n' {
 				line = line + 1
 				break
@@ -63,7 +196,8 @@ func (*Scanner) Scan(data string) (TokenList, error) {
 		}
 	}
 
-	for index < len(runes) {
+	for index < len(data) {
+		start := index
 		r := next()
 
 		if r == '\n' {
@@ -78,7 +212,48 @@ func (*Scanner) Scan(data string) (TokenList, error) {
 
 		switch r {
 		case '#':
-			comment()
+			// a hash following a sample on the same line starts an exemplar
+			if len(tokens) > 0 && tokens[len(tokens)-1].Line == line {
+				if !s.openMetrics {
+					comment()
+					continue
+				}
+				tokens = append(tokens, Token{
+					TokenType: TokenTypeHash,
+					Line:      line,
+				})
+				continue
+			}
+
+			blank()
+			keyword := word()
+			switch {
+			case keyword == "HELP":
+				err := metadata(TokenTypeHelp)
+				if err != nil {
+					return nil, err
+				}
+			case keyword == "TYPE":
+				err := metadata(TokenTypeType)
+				if err != nil {
+					return nil, err
+				}
+			case keyword == "UNIT" && s.openMetrics:
+				err := metadata(TokenTypeUnit)
+				if err != nil {
+					return nil, err
+				}
+			case keyword == "EOF" && s.openMetrics:
+				tokens = append(tokens, Token{
+					TokenType: TokenTypeEOF,
+					Line:      line,
+				})
+				comment()
+			case s.openMetrics:
+				return nil, errors.New(fmt.Sprintf("unexpected comment in line %v", line))
+			default:
+				comment()
+			}
 		case '{':
 			tokens = append(tokens, Token{
 				TokenType: TokenTypeLBrace,
@@ -90,11 +265,20 @@ func (*Scanner) Scan(data string) (TokenList, error) {
 				Line:      line,
 			})
 		case '"':
-			quoted = !quoted
 			tokens = append(tokens, Token{
 				TokenType: TokenTypeQuote,
 				Line:      line,
 			})
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, v)
+			tokens = append(tokens, Token{
+				TokenType: TokenTypeQuote,
+				Line:      line,
+			})
+			index = index + 1
 		case '=':
 			tokens = append(tokens, Token{
 				TokenType: TokenTypeEquals,
@@ -106,7 +290,7 @@ func (*Scanner) Scan(data string) (TokenList, error) {
 				Line:      line,
 			})
 		default:
-			tokens = append(tokens, name(r))
+			tokens = append(tokens, name(start))
 		}
 	}
 
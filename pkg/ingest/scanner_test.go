@@ -247,6 +247,334 @@ a_metric{name="value", foo="bar"} 1.0
 				},
 			},
 		},
+		{
+			data: `
+# HELP a_metric Some help text.
+# TYPE a_metric counter
+a_metric 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeHelp,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeText,
+					StringVal: "Some help text.",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeType,
+					Line:      2,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      2,
+				},
+				{
+					TokenType: TokenTypeText,
+					StringVal: "counter",
+					Line:      2,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      3,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      3,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name=""} 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeLBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "name",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeEquals,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeRBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name="say \"hi\""} 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeLBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "name",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeEquals,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: `say "hi"`,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeRBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name="C:\\Windows"} 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeLBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "name",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeEquals,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: `C:\Windows`,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeRBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name="two\nlines"} 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeLBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "name",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeEquals,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "two\nlines",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeRBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name="a,b={c} d"} 1.0
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeLBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "name",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeEquals,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a,b={c} d",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeQuote,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeRBrace,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "1.0",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+# HELP a_metric Path C:\\Windows\nsecond line.
+`,
+			wantError: false,
+			wantTokens: TokenList{
+				{
+					TokenType: TokenTypeHelp,
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeName,
+					StringVal: "a_metric",
+					Line:      1,
+				},
+				{
+					TokenType: TokenTypeText,
+					StringVal: "Path C:\\Windows\nsecond line.",
+					Line:      1,
+				},
+			},
+		},
+		{
+			data: `
+a_metric{name="\t"} 1.0
+`,
+			wantError: true,
+		},
+		{
+			data: `
+a_metric{name="unterminated} 1.0
+`,
+			wantError: true,
+		},
+		{
+			data: `
+# HELP a_metric Quotes \" are not escaped in help.
+`,
+			wantError: true,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -257,6 +585,10 @@ a_metric{name="value", foo="bar"} 1.0
 			t.Fatalf("unexpected error: %v", err)
 		}
 
+		if tc.wantError && err == nil {
+			t.Fatalf("expected error for %v", tc.data)
+		}
+
 		if !reflect.DeepEqual(tc.wantTokens, tokens) {
 			t.Fatalf("unexpected result, wanted %v, got %v", tc.wantTokens, tokens)
 		}
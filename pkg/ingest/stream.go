@@ -0,0 +1,222 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"scrape/api"
+	"strings"
+)
+
+// readSize is the size of the read buffer, the lines buffered are scanned from
+// a single string
+const readSize = 64 * 1024
+
+// StreamParser parses metrics responses in Prometheus or OpenMetrics text format
+// line by line from a reader. Samples are handed out as soon as they are parsed,
+// only the series of the histogram or summary currently being read are buffered.
+type StreamParser struct {
+	reader  *bufio.Reader
+	scanner *Scanner
+	parser  *Parser
+	line    int
+	open    string
+	builder *familyBuilder
+	// tokens is reused for every line
+	tokens TokenList
+}
+
+func NewStreamParser(r io.Reader) *StreamParser {
+	return &StreamParser{
+		reader:  bufio.NewReaderSize(r, readSize),
+		scanner: NewScanner(),
+		parser:  NewParser(nil),
+	}
+}
+
+func NewOpenMetricsStreamParser(r io.Reader) *StreamParser {
+	return &StreamParser{
+		reader:  bufio.NewReaderSize(r, readSize),
+		scanner: NewOpenMetricsScanner(),
+		parser:  NewOpenMetricsParser(nil),
+	}
+}
+
+// SetLenient makes the parser skip malformed lines instead of failing, the
+// skipped lines are reported by Diagnostics
+func (p *StreamParser) SetLenient(lenient bool) {
+	p.parser.SetLenient(lenient)
+}
+
+func (p *StreamParser) Diagnostics() []Diagnostic {
+	return p.parser.Diagnostics()
+}
+
+// flush completes the family that is currently open and hands out the samples
+// of its gauge histograms and the family itself, invalid series are dropped in
+// lenient mode
+func (p *StreamParser) flush(onSample func(api.Sample) error, onFamily func(api.Family) error) error {
+	if p.open == "" {
+		return nil
+	}
+	if p.builder == nil {
+		p.builder = newFamilyBuilder(*p.parser.metadata[p.open])
+	}
+
+	builder := p.builder
+	p.open = ""
+	p.builder = nil
+	family, gauges, err := builder.build(p.parser.diagnose)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range gauges {
+		err = onSample(sample)
+		if err != nil {
+			return err
+		}
+	}
+	return onFamily(*family)
+}
+
+// route groups the sample into the open family if it is part of a histogram or
+// summary, it returns true if the sample should be handed out
+func (p *StreamParser) route(sample *api.Sample) (bool, error) {
+	if p.open != "" && p.builder == nil {
+		p.builder = newFamilyBuilder(*p.parser.metadata[p.open])
+	}
+
+	name := sampleName(sample)
+	if p.builder != nil {
+		for _, suffix := range p.builder.suffixes() {
+			if name != p.builder.metadata.Name+suffix {
+				continue
+			}
+			err := checkExemplar(sample, p.builder, suffix)
+			if err != nil {
+				return false, err
+			}
+			if p.builder.grouped() {
+				return false, p.builder.add(sample, suffix, p.line)
+			}
+			return true, p.builder.validate(sample, suffix)
+		}
+	}
+	return true, checkExemplar(sample, nil, "")
+}
+
+// statement parses the tokens of a single line
+func (p *StreamParser) statement(tokens TokenList, onSample func(api.Sample) error, onFamily func(api.Family) error) error {
+	// metadata of another family or the end of the input closes the open family
+	closes := false
+	switch tokens[0].TokenType {
+	case TokenTypeHelp, TokenTypeType, TokenTypeUnit:
+		closes = len(tokens) > 1 && tokens[1].StringVal != p.open
+	case TokenTypeEOF:
+		closes = true
+	}
+	if closes {
+		err := p.flush(onSample, onFamily)
+		if err != nil {
+			return err
+		}
+		if tokens[0].TokenType != TokenTypeEOF {
+			p.open = tokens[1].StringVal
+		}
+	}
+
+	p.parser.tokens = tokens
+	p.parser.index = 0
+	sample, err := p.parser.statement()
+	if err == nil && p.parser.hasTokens() {
+		p.parser.consume()
+		err = unexpected(p.parser.current())
+	}
+	if err != nil {
+		current := p.parser.current()
+		return p.parser.diagnose(p.line, describeToken(current), err)
+	}
+	if sample == nil {
+		return nil
+	}
+
+	emit, err := p.route(sample)
+	if err != nil {
+		return p.parser.diagnose(p.line, sampleName(sample), err)
+	}
+	if !emit {
+		return nil
+	}
+	return onSample(*sample)
+}
+
+// read returns all complete lines that are buffered as one string, so that
+// they share a single allocation, or the next line if none is buffered
+func (p *StreamParser) read() (string, error) {
+	buffered, _ := p.reader.Peek(p.reader.Buffered())
+	end := bytes.LastIndexByte(buffered, '\n')
+	if end < 0 {
+		return p.reader.ReadString('\n')
+	}
+	data := string(buffered[:end+1])
+	_, err := p.reader.Discard(end + 1)
+	return data, err
+}
+
+// scanLine tokenizes and parses a single line
+func (p *StreamParser) scanLine(data string, onSample func(api.Sample) error, onFamily func(api.Family) error) error {
+	defer func() {
+		p.line = p.line + 1
+	}()
+
+	tokens, err := p.scanner.scan(data, p.line, p.tokens[:0])
+	if err != nil {
+		return p.parser.diagnose(p.line, "", err)
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	p.tokens = tokens
+	return p.statement(tokens, onSample, onFamily)
+}
+
+// Stream parses the input and calls onSample for every sample and onFamily for
+// every family announced by a HELP or TYPE line. Histograms and summaries are
+// only passed to onFamily. In strict mode parsing stops at the first error,
+// errors returned by the callbacks always stop parsing.
+func (p *StreamParser) Stream(onSample func(api.Sample) error, onFamily func(api.Family) error) error {
+	for {
+		data, readErr := p.read()
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		for data != "" {
+			end := strings.IndexByte(data, '\n') + 1
+			if end == 0 {
+				end = len(data)
+			}
+			err := p.scanLine(data[:end], onSample, onFamily)
+			if err != nil {
+				return err
+			}
+			data = data[end:]
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	err := p.flush(onSample, onFamily)
+	if err != nil {
+		return err
+	}
+
+	err = p.parser.finish()
+	if err != nil {
+		return p.parser.diagnose(p.line, "", err)
+	}
+	return nil
+}
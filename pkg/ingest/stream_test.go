@@ -0,0 +1,208 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"scrape/api"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func stream(parser *StreamParser) ([]api.Sample, []api.Family, error) {
+	var samples []api.Sample
+	var families []api.Family
+	err := parser.Stream(func(sample api.Sample) error {
+		samples = append(samples, sample)
+		return nil
+	}, func(family api.Family) error {
+		families = append(families, family)
+		return nil
+	})
+	return samples, families, err
+}
+
+func Test_StreamParser(t *testing.T) {
+	type testcase struct {
+		data        string
+		openMetrics bool
+		wantError   bool
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 1027 1697000000000
+http_requests_total{code="500"} 3
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 0.75
+latency_count 2
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.1
+rpc_sum 1
+rpc_count 4
+# a comment
+up 1`,
+		},
+		{
+			data: `# UNIT requests_seconds seconds
+# TYPE requests counter
+requests_total 3 # {trace_id="abc"} 1.5
+# TYPE latency histogram
+latency_bucket{le="+Inf"} 2
+latency_count 2
+# TYPE queue gaugehistogram
+queue_bucket{le="+Inf"} 3
+queue_gsum 4
+queue_gcount 3
+# EOF
+`,
+			openMetrics: true,
+		},
+		{
+			data: `# TYPE latency histogram
+latency_bucket{le="1"} 2
+# TYPE up gauge
+up 1
+`,
+			wantError: true,
+		},
+		{
+			data:        "up 1\n",
+			openMetrics: true,
+			wantError:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		scanner := NewScanner()
+		if tc.openMetrics {
+			scanner = NewOpenMetricsScanner()
+		}
+		tokens, err := scanner.Scan(tc.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		parser := NewParser(tokens)
+		streamParser := NewStreamParser(strings.NewReader(tc.data))
+		if tc.openMetrics {
+			parser = NewOpenMetricsParser(tokens)
+			streamParser = NewOpenMetricsStreamParser(strings.NewReader(tc.data))
+		}
+
+		wantSamples, wantFamilies, err := parser.Parse()
+		if tc.wantError != (err != nil) {
+			t.Fatalf("unexpected parser error: %v", err)
+		}
+
+		samples, families, err := stream(streamParser)
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !reflect.DeepEqual(wantSamples, samples) {
+			t.Fatalf("unexpected samples, wanted %v, got %v", wantSamples, samples)
+		}
+		if !reflect.DeepEqual(wantFamilies, families) {
+			t.Fatalf("unexpected families, wanted %v, got %v", wantFamilies, families)
+		}
+	}
+}
+
+func Test_StreamParserLineNumbers(t *testing.T) {
+	data := "up 1\n\nup{a=\"b\"} 1\nup{a=\"\\x\"} 1\n"
+	_, _, err := stream(NewStreamParser(strings.NewReader(data)))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected error in line 3, got %v", err)
+	}
+}
+
+// payload resembles the output of kube-state-metrics
+func Test_StreamParserReads(t *testing.T) {
+	data := payload(1000) + "up{a=\"\\n\"} 1"
+	tokens, err := NewScanner().Scan(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantSamples, wantFamilies, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// lines spanning several reads and lines split across reads
+	readers := []io.Reader{
+		strings.NewReader(data),
+		iotest.OneByteReader(strings.NewReader(data)),
+		iotest.HalfReader(strings.NewReader(data)),
+	}
+	for _, reader := range readers {
+		samples, families, err := stream(NewStreamParser(reader))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(wantSamples, samples) {
+			t.Fatalf("unexpected samples, wanted %v samples, got %v", len(wantSamples), len(samples))
+		}
+		if !reflect.DeepEqual(wantFamilies, families) {
+			t.Fatalf("unexpected families, wanted %v, got %v", wantFamilies, families)
+		}
+	}
+}
+
+func payload(series int) string {
+	sb := strings.Builder{}
+	sb.WriteString("# HELP kube_pod_status_phase The pods current phase.\n")
+	sb.WriteString("# TYPE kube_pod_status_phase gauge\n")
+	for i := 0; i < series; i++ {
+		sb.WriteString(fmt.Sprintf("kube_pod_status_phase{namespace=\"namespace-%d\",pod=\"pod-%d\",uid=\"%08d-0000-0000-0000-000000000000\",phase=\"Running\"} 1\n", i%100, i, i))
+	}
+	sb.WriteString("# HELP kube_pod_container_resource_requests The number of requested resources.\n")
+	sb.WriteString("# TYPE kube_pod_container_resource_requests gauge\n")
+	for i := 0; i < series; i++ {
+		sb.WriteString(fmt.Sprintf("kube_pod_container_resource_requests{namespace=\"namespace-%d\",pod=\"pod-%d\",container=\"main\",resource=\"cpu\",unit=\"core\"} 0.25\n", i%100, i))
+	}
+	return sb.String()
+}
+
+func Benchmark_Parser(b *testing.B) {
+	data := []byte(payload(10000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tokens, err := NewScanner().Scan(string(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _, err = NewParser(tokens).Parse()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_StreamParser(b *testing.B) {
+	data := payload(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := NewStreamParser(strings.NewReader(data)).Stream(func(sample api.Sample) error {
+			return nil
+		}, func(family api.Family) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
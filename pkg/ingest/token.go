@@ -7,6 +7,12 @@ const (
 	TokenTypeName
 	TokenTypeEquals
 	TokenTypeComma
+	TokenTypeHelp
+	TokenTypeType
+	TokenTypeText
+	TokenTypeUnit
+	TokenTypeEOF
+	TokenTypeHash
 )
 
 var TokenMapping = map[TokenType]string{
@@ -16,6 +22,12 @@ var TokenMapping = map[TokenType]string{
 	TokenTypeName:   "<name>",
 	TokenTypeEquals: "=",
 	TokenTypeComma:  ",",
+	TokenTypeHelp:   "# HELP",
+	TokenTypeType:   "# TYPE",
+	TokenTypeText:   "<text>",
+	TokenTypeUnit:   "# UNIT",
+	TokenTypeEOF:    "# EOF",
+	TokenTypeHash:   "#",
 }
 
 type TokenType int
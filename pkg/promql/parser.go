@@ -3,11 +3,17 @@ package promql
 import (
 	"database/sql"
 	"errors"
+	"math"
+	"scrape/api"
 	"time"
 )
 
+// LookbackDelta is how far an instant query looks back for the latest sample of
+// a series
+const LookbackDelta = 5 * time.Minute
+
 type PromQlASTElement interface {
-	Eval(db *sql.DB) error
+	Eval(db *sql.DB, at time.Time) ([]AggregatedTimeseries, error)
 }
 
 type PromQlTimeseries struct {
@@ -29,64 +35,103 @@ type AggregatedTimeseries struct {
 	Metric string
 	Labels []AggregatedLabel
 	Value  float64
+	// Timestamp of the sample in milliseconds since the epoch
+	Timestamp int64
 }
 
-func (s *PromQlTimeseries) Eval(db *sql.DB) error {
-	// get id of name label
-	stmt, err := db.Prepare(`select id from labels where name = ?;`)
-	if err != nil {
-		return err
-	}
-
-	result := stmt.QueryRow("__name__")
-	if result.Err() != nil {
-		return result.Err()
+// Eval returns the samples of the series with the name at the given time. An
+// instant query returns the latest sample of every series within the lookback
+// delta, a range query all samples within its duration. Staleness markers end
+// a series, so a series whose latest sample is a marker is left out.
+func (s *PromQlTimeseries) Eval(db *sql.DB, at time.Time) ([]AggregatedTimeseries, error) {
+	window := LookbackDelta
+	if s.Duration > 0 {
+		window = s.Duration
 	}
-
-	var id int64
-	err = result.Scan(&id)
+	end := at.UnixMilli()
+	start := at.Add(-window).UnixMilli()
+
+	// labels of the series in the order they were written, the labels of a
+	// series are stored again with every new sample
+	rows, err := db.Query(`
+select tl.timeseries_id, l.name, tl.label_value from timeseries_labels as tl join labels as l on tl.label_id = l.id where tl.timeseries_id in (select tl.timeseries_id from timeseries_labels as tl join labels as l on tl.label_id = l.id where l.name = '__name__' and tl.label_value = ?) group by tl.timeseries_id, l.name, tl.label_value order by min(tl.rowid);
+`, s.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// get samples id
-	stmt, err = db.Prepare(`
-select s.timeseries_id, tl.label_id, tl.label_value, s.value  from samples as s join timeseries_labels as tl on s.timeseries_id = tl.timeseries_id where s.timeseries_id in (select timeseries_id from timeseries_labels where label_id = ? and label_value = ?);
-`)
-	if err != nil {
-		return err
+	defer rows.Close()
+
+	series := map[int64]*AggregatedTimeseries{}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var label AggregatedLabel
+		err = rows.Scan(&id, &label.LabelName, &label.LabelValue)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := series[id]; !ok {
+			series[id] = &AggregatedTimeseries{}
+			ids = append(ids, id)
+		}
+		if label.LabelName == "__name__" {
+			series[id].Metric = label.LabelValue
+			continue
+		}
+		series[id].Labels = append(series[id].Labels, label)
 	}
-
-	timeseries, err := stmt.Query(id, s.Name)
-	if result.Err() != nil {
-		return result.Err()
+	if rows.Err() != nil {
+		return nil, rows.Err()
 	}
 
-	type sample = struct {
-		timeseries_id int
-		label_id      int
-		label_value   string
-		sample_value  float64
+	samples, err := db.Query(`
+select s.timeseries_id, s.timestamp, s.value, s.value_bits from samples as s where s.timeseries_id in (select tl.timeseries_id from timeseries_labels as tl join labels as l on tl.label_id = l.id where l.name = '__name__' and tl.label_value = ?) and s.timestamp > ? and s.timestamp <= ? order by s.timeseries_id, s.timestamp;
+`, s.Name, start, end)
+	if err != nil {
+		return nil, err
 	}
-
-	var samples []sample
-	for timeseries.Next() {
-		var s sample
-		err = timeseries.Scan(&s.timeseries_id, &s.label_id, &s.label_value, &s.sample_value)
+	defer samples.Close()
+
+	values := map[int64][]AggregatedTimeseries{}
+	for samples.Next() {
+		var id int64
+		var timestamp int64
+		var value sql.NullFloat64
+		var bits sql.NullInt64
+		err = samples.Scan(&id, &timestamp, &value, &bits)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		// NaN is stored as raw bits
+		sample := *series[id]
+		sample.Timestamp = timestamp
+		sample.Value = value.Float64
+		if !value.Valid {
+			sample.Value = math.Float64frombits(uint64(bits.Int64))
 		}
-		samples = append(samples, s)
+		values[id] = append(values[id], sample)
+	}
+	if samples.Err() != nil {
+		return nil, samples.Err()
 	}
 
-	var aggregated map[int]AggregatedTimeseries
-	for _, sample := range samples {
-		if _, ok := aggregated[sample.timeseries_id]; !ok {
-			aggregated[sample.timeseries_id] = AggregatedTimeseries{}
+	var result []AggregatedTimeseries
+	for _, id := range ids {
+		if s.Duration == 0 {
+			// only the latest sample counts for an instant query
+			n := len(values[id])
+			if n > 0 && !api.IsStaleNaN(values[id][n-1].Value) {
+				result = append(result, values[id][n-1])
+			}
+			continue
+		}
+		for _, sample := range values[id] {
+			if !api.IsStaleNaN(sample.Value) {
+				result = append(result, sample)
+			}
 		}
 	}
-
-	return nil
+	return result, nil
 }
 
 func NewPromQlParser(tokens []PromQlToken) *PromQlParser {
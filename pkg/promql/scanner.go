@@ -42,7 +42,6 @@ func (s *PromQlScanner) name() PromQlToken {
 		switch p {
 		case '[', ']':
 			goto end
-			break
 		default:
 			s.consume()
 			sb.WriteRune(p)
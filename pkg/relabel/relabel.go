@@ -0,0 +1,289 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"scrape/api"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Action string
+
+const (
+	Replace   Action = "replace"
+	Keep      Action = "keep"
+	Drop      Action = "drop"
+	LabelMap  Action = "labelmap"
+	LabelDrop Action = "labeldrop"
+	LabelKeep Action = "labelkeep"
+	HashMod   Action = "hashmod"
+	Lowercase Action = "lowercase"
+	Uppercase Action = "uppercase"
+)
+
+const (
+	DefaultSeparator   = ";"
+	DefaultRegex       = "(.*)"
+	DefaultReplacement = "$1"
+)
+
+var (
+	labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// target labels of the replace action may reference capture groups
+	targetLabelRegex = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+)
+
+// Regexp is a regular expression that always matches the whole string
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+func NewRegexp(s string) (Regexp, error) {
+	r, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return Regexp{}, err
+	}
+	return Regexp{
+		Regexp:   r,
+		original: s,
+	}, nil
+}
+
+func MustNewRegexp(s string) Regexp {
+	r, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *Regexp) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	parsed, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r Regexp) MarshalYAML() (interface{}, error) {
+	return r.original, nil
+}
+
+// String returns the expression without the anchors
+func (r Regexp) String() string {
+	return r.original
+}
+
+// Config is a single relabeling step, modelled on the Prometheus relabel_config
+type Config struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        Regexp   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       Action   `yaml:"action,omitempty"`
+}
+
+// DefaultConfig returns a config with all optional values set to their defaults
+func DefaultConfig() Config {
+	return Config{
+		Separator:   DefaultSeparator,
+		Regex:       MustNewRegexp(DefaultRegex),
+		Replacement: DefaultReplacement,
+		Action:      Replace,
+	}
+}
+
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	*c = DefaultConfig()
+	type plain Config
+	return value.Decode((*plain)(c))
+}
+
+// Validate checks that the config has all the fields its action requires
+func (c *Config) Validate() error {
+	if c.Regex.Regexp == nil {
+		c.Regex = MustNewRegexp(DefaultRegex)
+	}
+	if c.Action == "" {
+		c.Action = Replace
+	}
+
+	switch c.Action {
+	case Replace:
+		if !targetLabelRegex.MatchString(c.TargetLabel) {
+			return errors.New(fmt.Sprintf("invalid target_label %q for action %v", c.TargetLabel, c.Action))
+		}
+	case HashMod:
+		if !labelNameRegex.MatchString(c.TargetLabel) {
+			return errors.New(fmt.Sprintf("invalid target_label %q for action %v", c.TargetLabel, c.Action))
+		}
+		if c.Modulus == 0 {
+			return errors.New(fmt.Sprintf("modulus is required for action %v", c.Action))
+		}
+	case Lowercase, Uppercase:
+		if !labelNameRegex.MatchString(c.TargetLabel) {
+			return errors.New(fmt.Sprintf("invalid target_label %q for action %v", c.TargetLabel, c.Action))
+		}
+	case LabelDrop, LabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return errors.New(fmt.Sprintf("source_labels and target_label are not allowed for action %v", c.Action))
+		}
+	case LabelMap:
+		if c.TargetLabel != "" {
+			return errors.New(fmt.Sprintf("target_label is not allowed for action %v", c.Action))
+		}
+	case Keep, Drop:
+	default:
+		return errors.New(fmt.Sprintf("unknown relabel action %q", c.Action))
+	}
+
+	for _, name := range c.SourceLabels {
+		if !labelNameRegex.MatchString(name) {
+			return errors.New(fmt.Sprintf("invalid source label %q", name))
+		}
+	}
+	return nil
+}
+
+// Equal reports whether both configs relabel the same way
+func (c *Config) Equal(other *Config) bool {
+	if len(c.SourceLabels) != len(other.SourceLabels) {
+		return false
+	}
+	for i := range c.SourceLabels {
+		if c.SourceLabels[i] != other.SourceLabels[i] {
+			return false
+		}
+	}
+	return c.Separator == other.Separator &&
+		c.Regex.String() == other.Regex.String() &&
+		c.Modulus == other.Modulus &&
+		c.TargetLabel == other.TargetLabel &&
+		c.Replacement == other.Replacement &&
+		c.Action == other.Action
+}
+
+// builder modifies a label set while keeping the order of its labels
+type builder struct {
+	labels []api.Label
+}
+
+func (b *builder) get(name string) string {
+	for _, label := range b.labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// set replaces the value of a label, an empty value removes the label
+func (b *builder) set(name string, value string) {
+	if value == "" {
+		b.del(name)
+		return
+	}
+	for i := range b.labels {
+		if b.labels[i].Name == name {
+			b.labels[i].Value = value
+			return
+		}
+	}
+	b.labels = append(b.labels, api.Label{Name: name, Value: value})
+}
+
+func (b *builder) del(name string) {
+	for i := range b.labels {
+		if b.labels[i].Name == name {
+			b.labels = append(b.labels[:i], b.labels[i+1:]...)
+			return
+		}
+	}
+}
+
+// Process applies the configs to the labels in order. It returns the resulting
+// labels and false if the labels were dropped, the passed labels are not
+// modified.
+func Process(labels []api.Label, configs ...*Config) ([]api.Label, bool) {
+	b := &builder{
+		labels: make([]api.Label, len(labels)),
+	}
+	copy(b.labels, labels)
+
+	for _, c := range configs {
+		if !c.apply(b) {
+			return nil, false
+		}
+	}
+	return b.labels, true
+}
+
+// apply runs a single step, it returns false if the labels are dropped
+func (c *Config) apply(b *builder) bool {
+	values := make([]string, 0, len(c.SourceLabels))
+	for _, name := range c.SourceLabels {
+		values = append(values, b.get(name))
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case Keep:
+		return c.Regex.MatchString(value)
+	case Drop:
+		return !c.Regex.MatchString(value)
+	case Replace:
+		indexes := c.Regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+		target := string(c.Regex.ExpandString(nil, c.TargetLabel, value, indexes))
+		if !labelNameRegex.MatchString(target) {
+			return true
+		}
+		b.set(target, string(c.Regex.ExpandString(nil, c.Replacement, value, indexes)))
+	case Lowercase:
+		b.set(c.TargetLabel, strings.ToLower(value))
+	case Uppercase:
+		b.set(c.TargetLabel, strings.ToUpper(value))
+	case HashMod:
+		sum := md5.Sum([]byte(value))
+		mod := binary.BigEndian.Uint64(sum[8:]) % c.Modulus
+		b.set(c.TargetLabel, fmt.Sprintf("%v", mod))
+	case LabelMap:
+		var mapped []api.Label
+		for _, label := range b.labels {
+			if c.Regex.MatchString(label.Name) {
+				mapped = append(mapped, api.Label{
+					Name:  c.Regex.ReplaceAllString(label.Name, c.Replacement),
+					Value: label.Value,
+				})
+			}
+		}
+		for _, label := range mapped {
+			b.set(label.Name, label.Value)
+		}
+	case LabelDrop, LabelKeep:
+		var kept []api.Label
+		for _, label := range b.labels {
+			if c.Regex.MatchString(label.Name) == (c.Action == LabelKeep) {
+				kept = append(kept, label)
+			}
+		}
+		b.labels = kept
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+package relabel
+
+import (
+	"scrape/api"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func labels(pairs ...string) []api.Label {
+	var result []api.Label
+	for i := 0; i < len(pairs); i += 2 {
+		result = append(result, api.Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return result
+}
+
+func Test_Process(t *testing.T) {
+	type testcase struct {
+		name     string
+		input    []api.Label
+		configs  []*Config
+		want     []api.Label
+		wantDrop bool
+	}
+
+	testcases := []testcase{
+		{
+			name:  "replace with defaults copies the source label",
+			input: labels("__address__", "10.0.0.1:9100"),
+			configs: []*Config{
+				{SourceLabels: []string{"__address__"}, TargetLabel: "instance", Replacement: DefaultReplacement},
+			},
+			want: labels("__address__", "10.0.0.1:9100", "instance", "10.0.0.1:9100"),
+		},
+		{
+			name:  "replace with capture groups",
+			input: labels("__address__", "10.0.0.1:9100"),
+			configs: []*Config{
+				{SourceLabels: []string{"__address__"}, Regex: MustNewRegexp(`(.+):(\d+)`), TargetLabel: "host", Replacement: "${1}_$2"},
+			},
+			want: labels("__address__", "10.0.0.1:9100", "host", "10.0.0.1_9100"),
+		},
+		{
+			name:  "replace joins source labels with the separator",
+			input: labels("a", "x", "b", "y"),
+			configs: []*Config{
+				{SourceLabels: []string{"a", "b", "missing"}, Separator: "-", TargetLabel: "c", Replacement: DefaultReplacement},
+			},
+			want: labels("a", "x", "b", "y", "c", "x-y-"),
+		},
+		{
+			name:  "replace without a match is a no-op",
+			input: labels("a", "x"),
+			configs: []*Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("y"), TargetLabel: "a", Replacement: "z"},
+			},
+			want: labels("a", "x"),
+		},
+		{
+			name:  "replace with an empty result removes the label",
+			input: labels("a", "x", "b", "y"),
+			configs: []*Config{
+				{SourceLabels: []string{"a"}, TargetLabel: "b", Replacement: ""},
+			},
+			want: labels("a", "x"),
+		},
+		{
+			name:  "replace target label from a capture group",
+			input: labels("key", "env", "value", "prod"),
+			configs: []*Config{
+				{SourceLabels: []string{"key", "value"}, Separator: DefaultSeparator, Regex: MustNewRegexp("(.+);(.+)"), TargetLabel: "$1", Replacement: "$2"},
+			},
+			want: labels("key", "env", "value", "prod", "env", "prod"),
+		},
+		{
+			name:  "replace into an invalid label name is skipped",
+			input: labels("key", "1env"),
+			configs: []*Config{
+				{SourceLabels: []string{"key"}, TargetLabel: "$1", Replacement: "x"},
+			},
+			want: labels("key", "1env"),
+		},
+		{
+			name:  "the regex is anchored",
+			input: labels("__name__", "my_go_gc_seconds"),
+			configs: []*Config{
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("go_gc_.*"), Action: Drop},
+			},
+			want: labels("__name__", "my_go_gc_seconds"),
+		},
+		{
+			name:  "drop on match",
+			input: labels("__name__", "go_gc_duration_seconds"),
+			configs: []*Config{
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("go_gc_.*"), Action: Drop},
+			},
+			wantDrop: true,
+		},
+		{
+			name:  "keep on match",
+			input: labels("__name__", "http_requests_total", "code", "200"),
+			configs: []*Config{
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("http_.*"), Action: Keep},
+			},
+			want: labels("__name__", "http_requests_total", "code", "200"),
+		},
+		{
+			name:  "keep drops everything else",
+			input: labels("__name__", "go_goroutines"),
+			configs: []*Config{
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("http_.*"), Action: Keep},
+			},
+			wantDrop: true,
+		},
+		{
+			name:  "steps after a drop are not applied",
+			input: labels("a", "x"),
+			configs: []*Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("x"), Action: Drop},
+				{SourceLabels: []string{"a"}, TargetLabel: "b"},
+			},
+			wantDrop: true,
+		},
+		{
+			name:  "labelmap",
+			input: labels("__meta_kubernetes_pod_label_app", "web", "__meta_kubernetes_pod_label_tier", "frontend", "job", "pods"),
+			configs: []*Config{
+				{Regex: MustNewRegexp("__meta_kubernetes_pod_label_(.+)"), Replacement: "$1", Action: LabelMap},
+			},
+			want: labels("__meta_kubernetes_pod_label_app", "web", "__meta_kubernetes_pod_label_tier", "frontend", "job", "pods", "app", "web", "tier", "frontend"),
+		},
+		{
+			name:  "labeldrop",
+			input: labels("__name__", "up", "pod_template_hash", "abc", "pod", "web-1"),
+			configs: []*Config{
+				{Regex: MustNewRegexp("pod_.*"), Action: LabelDrop},
+			},
+			want: labels("__name__", "up", "pod", "web-1"),
+		},
+		{
+			name:  "labelkeep",
+			input: labels("__name__", "up", "pod_template_hash", "abc", "pod", "web-1"),
+			configs: []*Config{
+				{Regex: MustNewRegexp("__name__|pod"), Action: LabelKeep},
+			},
+			want: labels("__name__", "up", "pod", "web-1"),
+		},
+		{
+			name:  "hashmod",
+			input: labels("__address__", "10.0.0.1:9100"),
+			configs: []*Config{
+				{SourceLabels: []string{"__address__"}, Modulus: 8, TargetLabel: "__tmp_hash", Action: HashMod},
+			},
+			want: labels("__address__", "10.0.0.1:9100", "__tmp_hash", "5"),
+		},
+		{
+			name:  "lowercase",
+			input: labels("env", "PROD"),
+			configs: []*Config{
+				{SourceLabels: []string{"env"}, TargetLabel: "env", Action: Lowercase},
+			},
+			want: labels("env", "prod"),
+		},
+		{
+			name:  "uppercase",
+			input: labels("region", "eu-west-1"),
+			configs: []*Config{
+				{SourceLabels: []string{"region"}, TargetLabel: "region_upper", Action: Uppercase},
+			},
+			want: labels("region", "eu-west-1", "region_upper", "EU-WEST-1"),
+		},
+	}
+
+	for _, tc := range testcases {
+		for _, c := range tc.configs {
+			err := c.Validate()
+			if err != nil {
+				t.Fatalf("%v: unexpected error: %v", tc.name, err)
+			}
+		}
+
+		input := make([]api.Label, len(tc.input))
+		copy(input, tc.input)
+
+		got, kept := Process(input, tc.configs...)
+		if kept == tc.wantDrop {
+			t.Fatalf("%v: unexpected result, wanted drop %v, got %v", tc.name, tc.wantDrop, got)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("%v: unexpected labels, wanted %v, got %v", tc.name, tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%v: unexpected labels, wanted %v, got %v", tc.name, tc.want, got)
+			}
+		}
+		for i := range input {
+			if input[i] != tc.input[i] {
+				t.Fatalf("%v: input labels were modified", tc.name)
+			}
+		}
+	}
+}
+
+func Test_Unmarshal(t *testing.T) {
+	type testcase struct {
+		data      string
+		want      Config
+		wantError bool
+	}
+
+	testcases := []testcase{
+		{
+			data: `target_label: instance`,
+			want: Config{
+				Separator:   DefaultSeparator,
+				Regex:       MustNewRegexp(DefaultRegex),
+				TargetLabel: "instance",
+				Replacement: DefaultReplacement,
+				Action:      Replace,
+			},
+		},
+		{
+			data: `{source_labels: [__name__], regex: "go_gc_.*", action: drop}`,
+			want: Config{
+				SourceLabels: []string{"__name__"},
+				Separator:    DefaultSeparator,
+				Regex:        MustNewRegexp("go_gc_.*"),
+				Replacement:  DefaultReplacement,
+				Action:       Drop,
+			},
+		},
+		{
+			data:      `{source_labels: [a], regex: "(", action: drop}`,
+			wantError: true,
+		},
+		{
+			data:      `action: replace`,
+			wantError: true,
+		},
+		{
+			data:      `{action: hashmod, target_label: shard}`,
+			wantError: true,
+		},
+		{
+			data:      `{action: labeldrop, regex: x, target_label: y}`,
+			wantError: true,
+		},
+		{
+			data:      `action: explode`,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		c := &Config{}
+		err := yaml.Unmarshal([]byte(tc.data), c)
+		if err == nil {
+			err = c.Validate()
+		}
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", tc.data, err)
+		}
+		if !c.Equal(&tc.want) {
+			t.Fatalf("unexpected config for %v: %+v", tc.data, c)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package scrape
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncodingHeader is sent explicitly, so the transport does not decompress
+// responses on its own and the body size limit applies to the decompressed
+// stream of every encoding
+const acceptEncodingHeader = "zstd,gzip;q=0.9,deflate;q=0.8,identity;q=0.1"
+
+// zstdReader closes the decoder along with the response body
+type zstdReader struct {
+	*zstd.Decoder
+	limit int64
+}
+
+// Read reports frames whose window would not fit the body size limit like a
+// body exceeding the limit
+func (r zstdReader) Read(p []byte) (int, error) {
+	n, err := r.Decoder.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return n, errors.New(fmt.Sprintf("zstd window exceeds the body size limit of %v bytes", r.limit))
+	}
+	return n, err
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// isZlib reports whether the header is a zlib header, servers sending deflate
+// responses do not agree on whether to wrap the stream in zlib
+func isZlib(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// decompress wraps the body in a decoder for the content encoding of the
+// response, the memory of the zstd decoder is capped at the body size limit
+func decompress(body io.Reader, contentEncoding string, limit int64) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		reader := bufio.NewReader(body)
+		header, _ := reader.Peek(2)
+		if isZlib(header) {
+			return zlib.NewReader(reader)
+		}
+		return flate.NewReader(reader), nil
+	case "zstd":
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if limit > 0 {
+			window := uint64(limit)
+			if window < zstd.MinWindowSize {
+				window = zstd.MinWindowSize
+			}
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(limit)), zstd.WithDecoderMaxWindow(window))
+		}
+		decoder, err := zstd.NewReader(body, options...)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{decoder, limit}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported content encoding %q", contentEncoding))
+	}
+}
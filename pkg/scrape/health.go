@@ -0,0 +1,90 @@
+package scrape
+
+import (
+	"scrape/api"
+	"scrape/pkg/ingest"
+	"time"
+)
+
+// Health is the outcome of the last scrape of a target
+type Health string
+
+const (
+	HealthUnknown Health = "unknown"
+	HealthUp      Health = "up"
+	HealthDown    Health = "down"
+)
+
+// health is the state a scraper keeps about its target, a target is unknown
+// until its first scrape and then up or down depending on the last scrape
+type health struct {
+	health              Health
+	lastError           error
+	lastScrape          time.Time
+	lastScrapeDuration  time.Duration
+	consecutiveFailures int
+}
+
+// update moves to the state following a scrape, retries of the same scrape only
+// count once
+func (h *health) update(start time.Time, duration time.Duration, err error) {
+	h.lastError = err
+	h.lastScrape = start
+	h.lastScrapeDuration = duration
+	if err != nil {
+		h.health = HealthDown
+		h.consecutiveFailures++
+	} else {
+		h.health = HealthUp
+		h.consecutiveFailures = 0
+	}
+}
+
+// TargetState is a snapshot of a target and the outcome of its last scrape
+type TargetState struct {
+	Job      string
+	URL      string
+	Labels   []api.Label
+	Interval time.Duration
+	Timeout  time.Duration
+	Health   Health
+	// LastError is empty if the last scrape succeeded
+	LastError           string
+	LastScrape          time.Time
+	LastScrapeDuration  time.Duration
+	ConsecutiveFailures int
+	// Diagnostics are the lines skipped in the last scrape, DiagnosticsTotal
+	// counts the lines skipped since the target was added
+	Diagnostics      []ingest.Diagnostic
+	DiagnosticsTotal int
+}
+
+// State returns the current state of the target of the scraper
+func (s *UrlScaper) State() TargetState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := TargetState{
+		Job:                 s.target.Job,
+		URL:                 s.scrapeUrl.String(),
+		Labels:              s.target.labelSet(),
+		Interval:            s.target.Interval,
+		Timeout:             s.target.Timeout,
+		Health:              s.health.health,
+		LastScrape:          s.health.lastScrape,
+		LastScrapeDuration:  s.health.lastScrapeDuration,
+		ConsecutiveFailures: s.health.consecutiveFailures,
+		Diagnostics:         s.diagnostics,
+		DiagnosticsTotal:    s.diagnosticsTotal,
+	}
+	if s.health.lastError != nil {
+		state.LastError = s.health.lastError.Error()
+	}
+	return state
+}
+
+// retryBackoff returns the wait before the given retry, it doubles with every
+// retry
+func retryBackoff(initial time.Duration, retry int) time.Duration {
+	return initial << retry
+}
@@ -0,0 +1,69 @@
+package scrape
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"scrape/api"
+)
+
+// Limits bound what a single scrape of a target may return, a scrape exceeding
+// any of them fails. Zero disables a limit.
+type Limits struct {
+	BodySize         int64
+	Samples          int
+	Labels           int
+	LabelNameLength  int
+	LabelValueLength int
+}
+
+// checkSamples fails once more samples than allowed were kept by relabeling
+func (l Limits) checkSamples(samples int) error {
+	if l.Samples > 0 && samples > l.Samples {
+		return errors.New(fmt.Sprintf("sample limit of %v exceeded", l.Samples))
+	}
+	return nil
+}
+
+// checkLabels checks the labels of a sample after relabeling
+func (l Limits) checkLabels(labels []api.Label) error {
+	if l.Labels > 0 && len(labels) > l.Labels {
+		return errors.New(fmt.Sprintf("label limit of %v exceeded by %v labels", l.Labels, len(labels)))
+	}
+	for _, label := range labels {
+		if l.LabelNameLength > 0 && len(label.Name) > l.LabelNameLength {
+			return errors.New(fmt.Sprintf("label name length limit of %v exceeded by %q", l.LabelNameLength, label.Name))
+		}
+		if l.LabelValueLength > 0 && len(label.Value) > l.LabelValueLength {
+			return errors.New(fmt.Sprintf("label value length limit of %v exceeded by label %q", l.LabelValueLength, label.Name))
+		}
+	}
+	return nil
+}
+
+// limitedReader fails once more than limit bytes have been read
+type limitedReader struct {
+	reader    io.Reader
+	limit     int64
+	remaining int64
+}
+
+func newLimitedReader(reader io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return reader
+	}
+	return &limitedReader{
+		reader:    reader,
+		limit:     limit,
+		remaining: limit,
+	}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errors.New(fmt.Sprintf("body size limit of %v bytes exceeded", r.limit))
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package scrape
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Manager keeps the running scrapers in line with the configured targets
+type Manager struct {
+	scheduler *Scheduler
+	strict    bool
+	wg        *sync.WaitGroup
+	mutex     sync.Mutex
+	scrapers  map[string]*UrlScaper
+}
+
+func NewManager(scheduler *Scheduler, strict bool, wg *sync.WaitGroup) *Manager {
+	return &Manager{
+		scheduler: scheduler,
+		strict:    strict,
+		wg:        wg,
+		scrapers:  map[string]*UrlScaper{},
+	}
+}
+
+// key identifies a target across reloads
+func (t *Target) key() string {
+	return t.Job + "\xff" + t.URL.String()
+}
+
+// equal reports whether both targets are scraped with the same settings
+func (t *Target) equal(other *Target) bool {
+	if t.key() != other.key() || t.Interval != other.Interval || t.Timeout != other.Timeout || t.HonorLabels != other.HonorLabels || t.Limits != other.Limits {
+		return false
+	}
+	if t.Retries != other.Retries || t.RetryBackoff != other.RetryBackoff {
+		return false
+	}
+	if len(t.Labels) != len(other.Labels) {
+		return false
+	}
+	for i := range t.Labels {
+		if t.Labels[i] != other.Labels[i] {
+			return false
+		}
+	}
+	if len(t.MetricRelabelConfigs) != len(other.MetricRelabelConfigs) {
+		return false
+	}
+	for i := range t.MetricRelabelConfigs {
+		if !t.MetricRelabelConfigs[i].Equal(other.MetricRelabelConfigs[i]) {
+			return false
+		}
+	}
+	return reflect.DeepEqual(t.HTTPClientConfig, other.HTTPClientConfig)
+}
+
+// Sync starts scrapers for new targets, stops the scrapers of targets that are
+// gone and restarts the scrapers of targets whose settings have changed.
+// Targets that did not change keep their scraper. Only the series of targets
+// that are gone are marked stale. Targets whose scraper cannot be created are
+// skipped, the first error is returned.
+func (m *Manager) Sync(targets []*Target) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wanted := map[string]*Target{}
+	for _, target := range targets {
+		wanted[target.key()] = target
+	}
+
+	for key, scraper := range m.scrapers {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		m.scheduler.Remove(scraper)
+		delete(m.scrapers, key)
+		log.Printf("[scrape] target %v removed", scraper.scrapeUrl)
+	}
+
+	var first error
+	for key, target := range wanted {
+		running, ok := m.scrapers[key]
+		if ok && running.target.equal(target) {
+			continue
+		}
+		scraper, err := NewUrlScaper(target, m.strict, m.wg)
+		if err != nil {
+			log.Printf("[scrape] skipping target %v: %v", target.URL, err)
+			if first == nil {
+				first = err
+			}
+			if ok {
+				m.scheduler.Remove(running)
+				delete(m.scrapers, key)
+			}
+			continue
+		}
+		m.scrapers[key] = scraper
+		if ok {
+			log.Printf("[scrape] target %v changed", scraper.scrapeUrl)
+			m.scheduler.Replace(running, scraper)
+			continue
+		}
+		m.scheduler.Add(scraper)
+	}
+
+	return first
+}
+
+// Scrapers returns the running scrapers
+func (m *Manager) Scrapers() []*UrlScaper {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var scrapers []*UrlScaper
+	for _, scraper := range m.scrapers {
+		scrapers = append(scrapers, scraper)
+	}
+	return scrapers
+}
+
+// Targets returns the state of all running targets ordered by job and url
+func (m *Manager) Targets() []TargetState {
+	var targets []TargetState
+	for _, scraper := range m.Scrapers() {
+		targets = append(targets, scraper.State())
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Job != targets[j].Job {
+			return targets[i].Job < targets[j].Job
+		}
+		return targets[i].URL < targets[j].URL
+	})
+	return targets
+}
@@ -0,0 +1,178 @@
+package scrape
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"scrape/api"
+	"scrape/pkg/relabel"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ManagerSync(t *testing.T) {
+	target := func(job string, address string, labels ...api.Label) *Target {
+		return &Target{
+			Job:      job,
+			URL:      &url.URL{Scheme: "http", Host: address, Path: "/metrics"},
+			Interval: time.Hour,
+			Timeout:  time.Second,
+			Labels:   labels,
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	scheduler := NewScheduler(make(chan api.Sample), make(chan *api.Batch))
+	manager := NewManager(scheduler, false, wg)
+
+	err := manager.Sync([]*Target{
+		target("node", "a:9100"),
+		target("node", "b:9100"),
+		target("app", "a:8080"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := map[string]*UrlScaper{}
+	for _, scraper := range manager.Scrapers() {
+		before[scraper.target.key()] = scraper
+	}
+	if len(before) != 3 {
+		t.Fatalf("expected 3 scrapers, got %v", len(before))
+	}
+
+	// b is removed, app changes its labels and c is added
+	err = manager.Sync([]*Target{
+		target("node", "a:9100"),
+		target("node", "c:9100"),
+		target("app", "a:8080", api.Label{Name: "env", Value: "prod"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := map[string]*UrlScaper{}
+	for _, scraper := range manager.Scrapers() {
+		after[scraper.target.key()] = scraper
+	}
+
+	type testcase struct {
+		target    *Target
+		running   bool
+		unchanged bool
+	}
+
+	testcases := []testcase{
+		{target: target("node", "a:9100"), running: true, unchanged: true},
+		{target: target("node", "b:9100"), running: false},
+		{target: target("node", "c:9100"), running: true},
+		{target: target("app", "a:8080"), running: true, unchanged: false},
+	}
+
+	for _, tc := range testcases {
+		scraper, ok := after[tc.target.key()]
+		if ok != tc.running {
+			t.Fatalf("unexpected state of %v, wanted running %v", tc.target.key(), tc.running)
+		}
+		if ok && (scraper == before[tc.target.key()]) != tc.unchanged {
+			t.Fatalf("unexpected scraper of %v, wanted unchanged %v", tc.target.key(), tc.unchanged)
+		}
+	}
+
+	if len(scheduler.running) != 3 {
+		t.Fatalf("expected 3 scheduled scrapers, got %v", len(scheduler.running))
+	}
+
+	scheduler.Stop()
+	wg.Wait()
+}
+
+func Test_ManagerSyncStaleness(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("requests_total 1\nerrors_total 1\n"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	samples := make(chan api.Sample, 512)
+	wg := &sync.WaitGroup{}
+	scheduler := NewScheduler(samples, testBatches(samples, make(chan api.Family, 512)))
+	manager := NewManager(scheduler, true, wg)
+
+	// scraped waits until the running scraper of the target has scraped it
+	scraped := func() *UrlScaper {
+		for i := 0; i < 100; i++ {
+			scrapers := manager.Scrapers()
+			if len(scrapers) == 1 && scrapers[0].State().Health == HealthUp {
+				return scrapers[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("target was not scraped")
+		return nil
+	}
+
+	type testcase struct {
+		interval time.Duration
+		relabel  []*relabel.Config
+	}
+
+	testcases := []testcase{
+		{interval: 100 * time.Millisecond},
+		{interval: 200 * time.Millisecond},
+		{
+			// the new scraper marks the series it drops stale
+			interval: 200 * time.Millisecond,
+			relabel: []*relabel.Config{
+				{SourceLabels: []string{"__name__"}, Regex: relabel.MustNewRegexp("errors_total"), Action: relabel.Drop},
+			},
+		},
+	}
+
+	var previous *UrlScaper
+	for _, tc := range testcases {
+		err := manager.Sync([]*Target{{Job: "node", URL: u, Interval: tc.interval, Timeout: 50 * time.Millisecond, MetricRelabelConfigs: tc.relabel}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		scraper := scraped()
+		if scraper == previous {
+			t.Fatalf("scraper was not restarted after changing the interval")
+		}
+		previous = scraper
+	}
+
+	err := manager.Sync(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(samples)
+
+	// changing the interval keeps the series, dropping errors_total marks it
+	// stale and removing the target marks requests_total and the 5 synthetic
+	// series stale once
+	stale := map[string]int{}
+	added := 0
+	for sample := range samples {
+		if api.IsStaleNaN(sample.Value) {
+			stale[seriesKey(sample.Labels)]++
+			continue
+		}
+		// the series are only new to the first scraper
+		if sample.Labels[0].Value == "scrape_series_added" && sample.Value > 0 {
+			added++
+		}
+	}
+	if len(stale) != 7 {
+		t.Fatalf("unexpected stale series %v", stale)
+	}
+	if added != 1 {
+		t.Fatalf("series were added by %v scrapes, wanted 1", added)
+	}
+	for key, count := range stale {
+		if count != 1 {
+			t.Fatalf("series %q marked stale %v times", key, count)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package scrape
+
+import (
+	"scrape/api"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scrapeReport collects the figures of a single scrape that are written as
+// synthetic series alongside the scraped samples
+type scrapeReport struct {
+	scraped        int
+	postRelabeling int
+	// series kept by relabeling by their key
+	series map[string][]api.Label
+	// batches receives the batch of the scrape along with its first sample,
+	// the batch is committed once the scrape succeeded
+	batches chan<- *api.Batch
+	batch   *api.Batch
+	// timestamp is the start of the scrape in milliseconds, samples without a
+	// timestamp of their own are written with it
+	timestamp int64
+}
+
+func newScrapeReport(batches chan<- *api.Batch, start time.Time) *scrapeReport {
+	return &scrapeReport{
+		series:    map[string][]api.Label{},
+		batches:   batches,
+		timestamp: start.UnixMilli(),
+	}
+}
+
+// seriesKey identifies a series independent of the order of its labels
+func seriesKey(labels []api.Label) string {
+	sorted := make([]api.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	sb := strings.Builder{}
+	for _, label := range sorted {
+		sb.WriteString(label.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(label.Value)
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+// add counts a sample that has been kept by relabeling, the labels are copied
+// so that they do not keep the response body in memory
+func (r *scrapeReport) add(labels []api.Label) {
+	r.postRelabeling++
+	key := seriesKey(labels)
+	if _, ok := r.series[key]; ok {
+		return
+	}
+	copied := make([]api.Label, len(labels))
+	for i, label := range labels {
+		copied[i] = api.Label{
+			Name:  strings.Clone(label.Name),
+			Value: strings.Clone(label.Value),
+		}
+	}
+	r.series[key] = copied
+}
+
+// start sends the batch of the scrape to the store
+func (r *scrapeReport) start() *api.Batch {
+	if r.batch == nil {
+		r.batch = api.NewBatch()
+		r.batches <- r.batch
+	}
+	return r.batch
+}
+
+func (r *scrapeReport) write(sample api.Sample) {
+	r.start().Samples <- sample
+}
+
+func (r *scrapeReport) writeFamily(family api.Family) {
+	r.start().Families <- family
+}
+
+// finish commits or rolls back the batch of the scrape and waits for the store
+// to complete it
+func (r *scrapeReport) finish(commit bool) {
+	if r.batch == nil {
+		return
+	}
+	r.batch.Commit <- commit
+	<-r.batch.Done
+	r.batch = nil
+}
+
+// discard rolls back the samples of a failed scrape, none of its series are
+// written
+func (r *scrapeReport) discard() {
+	r.finish(false)
+	r.series = map[string][]api.Label{}
+}
+
+// added returns the number of series that were not part of the previous scrape
+func (r *scrapeReport) added(previous map[string][]api.Label) int {
+	added := 0
+	for key := range r.series {
+		if _, ok := previous[key]; !ok {
+			added++
+		}
+	}
+	return added
+}
+
+// staleSamples returns a staleness marker for every series written by the
+// previous scrape that is not part of the current one
+func staleSamples(previous map[string][]api.Label, current map[string][]api.Label, timestamp int64) []api.Sample {
+	var samples []api.Sample
+	for key, labels := range previous {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		samples = append(samples, api.Sample{
+			Labels:    labels,
+			Value:     api.StaleNaN,
+			Timestamp: api.Timestamp(timestamp),
+		})
+	}
+	return samples
+}
+
+// reportLabels returns the labels of the synthetic series of the target
+func (s *UrlScaper) reportLabels(name string) []api.Label {
+	return append([]api.Label{{Name: "__name__", Value: name}}, s.target.labelSet()...)
+}
+
+// reportSamples returns the synthetic series describing the health of the
+// target, they are written on every scrape, including failed ones
+func (s *UrlScaper) reportSamples(start time.Time, duration time.Duration, err error, report *scrapeReport) []api.Sample {
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"up", up},
+		{"scrape_duration_seconds", duration.Seconds()},
+		{"scrape_samples_scraped", float64(report.scraped)},
+		{"scrape_samples_post_metric_relabeling", float64(report.postRelabeling)},
+		{"scrape_series_added", float64(report.added(s.series))},
+	}
+
+	var samples []api.Sample
+	for _, v := range values {
+		samples = append(samples, api.Sample{
+			Labels:    s.reportLabels(v.name),
+			Value:     v.value,
+			Timestamp: api.Timestamp(start.UnixMilli()),
+		})
+	}
+	return samples
+}
@@ -0,0 +1,102 @@
+package scrape
+
+import (
+	"hash/fnv"
+	"scrape/api"
+	"sync"
+	"time"
+)
+
+// offset returns the position of the target within its interval. It is derived
+// from a hash of the target, so it is stable across restarts and targets with
+// the same interval are spread evenly instead of being scraped all at once.
+func offset(target *Target) time.Duration {
+	if target.Interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(target.Job))
+	h.Write([]byte{0xff})
+	h.Write([]byte(target.URL.String()))
+	return time.Duration(h.Sum64() % uint64(target.Interval))
+}
+
+// nextScrape returns the first point in time after now that is aligned to the
+// interval plus the offset of the target
+func nextScrape(now time.Time, interval time.Duration, offset time.Duration) time.Time {
+	if interval <= 0 {
+		return now
+	}
+	aligned := time.Unix(0, now.UnixNano()-now.UnixNano()%int64(interval)).Add(offset)
+	for !aligned.After(now) {
+		aligned = aligned.Add(interval)
+	}
+	return aligned
+}
+
+// Scheduler runs every scraper on its own timer
+type Scheduler struct {
+	samples chan<- api.Sample
+	batches chan<- *api.Batch
+	mutex   sync.Mutex
+	running map[*UrlScaper]chan bool
+}
+
+func NewScheduler(samples chan<- api.Sample, batches chan<- *api.Batch) *Scheduler {
+	return &Scheduler{
+		samples: samples,
+		batches: batches,
+		running: map[*UrlScaper]chan bool{},
+	}
+}
+
+// Add starts scraping the target of the scraper at its interval
+func (s *Scheduler) Add(scraper *UrlScaper) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	quit := make(chan bool)
+	s.running[scraper] = quit
+	scraper.Scrape(s.samples, s.batches, quit)
+}
+
+// Remove stops the scraper and marks the series of its target stale, a scrape
+// in progress is completed first
+func (s *Scheduler) Remove(scraper *UrlScaper) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if quit, ok := s.running[scraper]; ok {
+		scraper.markRemoved()
+		close(quit)
+		delete(s.running, scraper)
+	}
+}
+
+// Replace stops the scraper of a target whose settings changed and starts the
+// new one in its place. The series of the target are not marked stale, the new
+// scraper takes them over and marks those stale that it no longer scrapes.
+func (s *Scheduler) Replace(old *UrlScaper, scraper *UrlScaper) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if quit, ok := s.running[old]; ok {
+		close(quit)
+		delete(s.running, old)
+		scraper.previous = old
+	}
+	quit := make(chan bool)
+	s.running[scraper] = quit
+	scraper.Scrape(s.samples, s.batches, quit)
+}
+
+// Stop stops all scrapers
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for scraper, quit := range s.running {
+		close(quit)
+		delete(s.running, scraper)
+	}
+}
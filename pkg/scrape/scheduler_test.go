@@ -0,0 +1,130 @@
+package scrape
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"scrape/api"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Offset(t *testing.T) {
+	interval := 10 * time.Second
+	offsets := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://host-%d:9100/metrics", i))
+		target := &Target{Job: "node", URL: u, Interval: interval}
+
+		o := offset(target)
+		if o < 0 || o >= interval {
+			t.Fatalf("offset %v out of range", o)
+		}
+		if offset(target) != o {
+			t.Fatalf("offset is not deterministic")
+		}
+		offsets[o] = true
+	}
+
+	if len(offsets) < 95 {
+		t.Fatalf("offsets are not spread, got %v distinct values", len(offsets))
+	}
+}
+
+func Test_NextScrape(t *testing.T) {
+	type testcase struct {
+		now      time.Time
+		interval time.Duration
+		offset   time.Duration
+		want     time.Time
+	}
+
+	base := time.Unix(1697000000, 0)
+	testcases := []testcase{
+		{
+			now:      base,
+			interval: 10 * time.Second,
+			offset:   3 * time.Second,
+			want:     base.Add(3 * time.Second),
+		},
+		{
+			now:      base.Add(4 * time.Second),
+			interval: 10 * time.Second,
+			offset:   3 * time.Second,
+			want:     base.Add(13 * time.Second),
+		},
+		{
+			// exactly on the slot, the next one is due
+			now:      base.Add(3 * time.Second),
+			interval: 10 * time.Second,
+			offset:   3 * time.Second,
+			want:     base.Add(13 * time.Second),
+		},
+		{
+			now:      base.Add(9 * time.Second),
+			interval: 10 * time.Second,
+			offset:   0,
+			want:     base.Add(10 * time.Second),
+		},
+	}
+
+	for _, tc := range testcases {
+		got := nextScrape(tc.now, tc.interval, tc.offset)
+		if !got.Equal(tc.want) {
+			t.Fatalf("unexpected next scrape, wanted %v, got %v", tc.want, got)
+		}
+	}
+}
+
+func Test_Scheduler(t *testing.T) {
+	var hits [2]int32
+	var servers []*httptest.Server
+	for i := range hits {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			w.Write([]byte("up 1\n"))
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	samples := make(chan api.Sample, 512)
+	families := make(chan api.Family, 512)
+	wg := &sync.WaitGroup{}
+	scheduler := NewScheduler(samples, testBatches(samples, families))
+
+	interval := 100 * time.Millisecond
+	var scrapers []*UrlScaper
+	for _, server := range servers {
+		u, _ := url.Parse(server.URL)
+		scraper, err := NewUrlScaper(&Target{Job: "test", URL: u, Interval: interval, Timeout: interval}, true, wg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scrapers = append(scrapers, scraper)
+		scheduler.Add(scraper)
+	}
+
+	time.Sleep(10 * interval)
+	scheduler.Remove(scrapers[0])
+	removed := atomic.LoadInt32(&hits[0])
+	time.Sleep(3 * interval)
+	scheduler.Stop()
+	wg.Wait()
+
+	// every target is scraped once per interval
+	for i := range hits {
+		got := atomic.LoadInt32(&hits[i])
+		if got < 8 || got > 14 {
+			t.Fatalf("target %v scraped %v times", i, got)
+		}
+	}
+
+	if atomic.LoadInt32(&hits[0]) != removed {
+		t.Fatalf("removed target was scraped again")
+	}
+}
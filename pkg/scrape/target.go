@@ -0,0 +1,230 @@
+package scrape
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"scrape/api"
+	"scrape/pkg/config"
+	"scrape/pkg/discovery"
+	"scrape/pkg/relabel"
+	"sort"
+	"strings"
+	"time"
+)
+
+// labels describing how to scrape a target, they can be changed by relabeling
+// and are removed before scraping like all labels starting with __
+const (
+	addressLabel     = "__address__"
+	schemeLabel      = "__scheme__"
+	metricsPathLabel = "__metrics_path__"
+	paramLabelPrefix = "__param_"
+)
+
+// Target is an endpoint to scrape along with the settings of its job
+type Target struct {
+	Job      string
+	URL      *url.URL
+	Interval time.Duration
+	Timeout  time.Duration
+	// Labels are attached to every sample scraped from the target
+	Labels []api.Label
+	// HonorLabels keeps exposed labels that conflict with target labels
+	HonorLabels bool
+	// MetricRelabelConfigs are applied to every scraped sample
+	MetricRelabelConfigs []*relabel.Config
+	Limits               Limits
+	HTTPClientConfig     config.HTTPClientConfig
+	// Retries is how often a failed scrape is retried before the next one is
+	// due, waiting RetryBackoff before the first retry
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// labelSet returns the job and instance labels of the target followed by its
+// static labels, static labels may override job and instance
+func (t *Target) labelSet() []api.Label {
+	labels := []api.Label{
+		{Name: "job", Value: t.Job},
+		{Name: "instance", Value: t.URL.Host},
+	}
+	for _, label := range t.Labels {
+		switch label.Name {
+		case "job":
+			labels[0].Value = label.Value
+		case "instance":
+			labels[1].Value = label.Value
+		default:
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func sortedLabels(labels map[string]string) []api.Label {
+	var result []api.Label
+	for name, value := range labels {
+		result = append(result, api.Label{
+			Name:  name,
+			Value: value,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// targetLabels returns the labels of a target before relabeling, the labels of
+// the target take precedence over those of its group which take precedence
+// over the defaults of the job
+func targetLabels(sc *config.ScrapeConfig, target map[string]string, group map[string]string) []api.Label {
+	result := []api.Label{
+		{Name: "job", Value: sc.JobName},
+		{Name: addressLabel},
+		{Name: schemeLabel, Value: sc.Scheme},
+		{Name: metricsPathLabel, Value: sc.MetricsPath},
+	}
+
+	var params []string
+	for name := range sc.Params {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		if len(sc.Params[name]) > 0 {
+			result = append(result, api.Label{Name: paramLabelPrefix + name, Value: sc.Params[name][0]})
+		}
+	}
+
+	set := func(label api.Label) {
+		for i := range result {
+			if result[i].Name == label.Name {
+				result[i].Value = label.Value
+				return
+			}
+		}
+		result = append(result, label)
+	}
+	for _, label := range sortedLabels(group) {
+		if _, ok := target[label.Name]; !ok {
+			set(label)
+		}
+	}
+	for _, label := range sortedLabels(target) {
+		set(label)
+	}
+	return result
+}
+
+// newTarget relabels the labels of a target and creates the target from the
+// result, nil is returned if relabeling dropped the target
+func newTarget(sc *config.ScrapeConfig, labels []api.Label) (*Target, error) {
+	labels, keep := relabel.Process(labels, sc.RelabelConfigs...)
+	if !keep {
+		return nil, nil
+	}
+
+	get := func(name string) string {
+		for _, label := range labels {
+			if label.Name == name {
+				return label.Value
+			}
+		}
+		return ""
+	}
+
+	address := get(addressLabel)
+	if address == "" {
+		return nil, errors.New("no address")
+	}
+	if strings.Contains(address, "/") {
+		return nil, errors.New(fmt.Sprintf("invalid address %q", address))
+	}
+	scheme := get(schemeLabel)
+	if scheme != "http" && scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("unsupported scheme %q for %v", scheme, address))
+	}
+
+	query := url.Values{}
+	for name, values := range sc.Params {
+		query[name] = values
+	}
+
+	var result []api.Label
+	instance := false
+	for _, label := range labels {
+		if strings.HasPrefix(label.Name, paramLabelPrefix) {
+			query.Set(strings.TrimPrefix(label.Name, paramLabelPrefix), label.Value)
+			continue
+		}
+		if strings.HasPrefix(label.Name, "__") {
+			continue
+		}
+		if label.Name == "instance" {
+			instance = true
+		}
+		result = append(result, label)
+	}
+	if !instance {
+		result = append(result, api.Label{Name: "instance", Value: address})
+	}
+
+	return &Target{
+		Job: sc.JobName,
+		URL: &url.URL{
+			Scheme:   scheme,
+			Host:     address,
+			Path:     get(metricsPathLabel),
+			RawQuery: query.Encode(),
+		},
+		Interval:             time.Duration(sc.ScrapeInterval),
+		Timeout:              time.Duration(sc.ScrapeTimeout),
+		Labels:               result,
+		HonorLabels:          sc.HonorLabels,
+		MetricRelabelConfigs: sc.MetricRelabelConfigs,
+		Limits: Limits{
+			BodySize:         int64(sc.BodySizeLimit),
+			Samples:          sc.SampleLimit,
+			Labels:           sc.LabelLimit,
+			LabelNameLength:  sc.LabelNameLengthLimit,
+			LabelValueLength: sc.LabelValueLengthLimit,
+		},
+		HTTPClientConfig: sc.HTTPClientConfig,
+		Retries:          sc.ScrapeRetries,
+		RetryBackoff:     time.Duration(sc.ScrapeRetryBackoff),
+	}, nil
+}
+
+// TargetsFromConfig creates a target for every static target and every
+// discovered target of every job, targets that cannot be created after
+// relabeling are skipped
+func TargetsFromConfig(c *config.Config, groups map[string][]*discovery.Group) []*Target {
+	var targets []*Target
+	add := func(sc *config.ScrapeConfig, target map[string]string, group map[string]string) {
+		t, err := newTarget(sc, targetLabels(sc, target, group))
+		if err != nil {
+			log.Printf("[scrape] skipping target %v of job %v: %v", target[addressLabel], sc.JobName, err)
+			return
+		}
+		if t != nil {
+			targets = append(targets, t)
+		}
+	}
+
+	for _, sc := range c.ScrapeConfigs {
+		for _, static := range sc.StaticConfigs {
+			for _, address := range static.Targets {
+				add(sc, map[string]string{addressLabel: address}, static.Labels)
+			}
+		}
+		for _, group := range groups[sc.JobName] {
+			for _, target := range group.Targets {
+				add(sc, target, group.Labels)
+			}
+		}
+	}
+	return targets
+}
@@ -0,0 +1,193 @@
+package scrape
+
+import (
+	"scrape/api"
+	"scrape/pkg/config"
+	"scrape/pkg/discovery"
+	"testing"
+)
+
+func Test_TargetsFromConfig(t *testing.T) {
+	type target struct {
+		url    string
+		labels []api.Label
+	}
+
+	type testcase struct {
+		data string
+		want []target
+	}
+
+	testcases := []testcase{
+		{
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["a:9100"]
+        labels:
+          env: prod
+`,
+			want: []target{
+				{
+					url: "http://a:9100/metrics",
+					labels: []api.Label{
+						{Name: "job", Value: "node"},
+						{Name: "env", Value: "prod"},
+						{Name: "instance", Value: "a:9100"},
+					},
+				},
+			},
+		},
+		{
+			// targets can be dropped and rewritten
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["a:9100", "b:9100"]
+    relabel_configs:
+      - source_labels: [__address__]
+        regex: "b:.*"
+        action: drop
+      - source_labels: [__address__]
+        regex: "(.*):9100"
+        target_label: instance
+      - source_labels: [__address__]
+        regex: "(.*):9100"
+        target_label: __address__
+        replacement: "$1:9200"
+`,
+			want: []target{
+				{
+					url: "http://a:9200/metrics",
+					labels: []api.Label{
+						{Name: "job", Value: "node"},
+						{Name: "instance", Value: "a"},
+					},
+				},
+			},
+		},
+		{
+			// the scheme, path and params of a target come from labels
+			data: `
+scrape_configs:
+  - job_name: snmp
+    params:
+      module: [if_mib]
+    static_configs:
+      - targets: ["switch:161"]
+    relabel_configs:
+      - source_labels: [__address__]
+        target_label: __param_target
+      - target_label: __scheme__
+        replacement: https
+      - target_label: __metrics_path__
+        replacement: /snmp
+      - target_label: __address__
+        replacement: exporter:9116
+      - source_labels: [__param_target]
+        target_label: instance
+`,
+			want: []target{
+				{
+					url: "https://exporter:9116/snmp?module=if_mib&target=switch%3A161",
+					labels: []api.Label{
+						{Name: "job", Value: "snmp"},
+						{Name: "instance", Value: "switch:161"},
+					},
+				},
+			},
+		},
+		{
+			// targets with an invalid address are skipped
+			data: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["a:9100"]
+    relabel_configs:
+      - target_label: __address__
+        replacement: "a:9100/metrics"
+`,
+		},
+	}
+
+	for _, tc := range testcases {
+		c, err := config.Load([]byte(tc.data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		targets := TargetsFromConfig(c, nil)
+		if len(targets) != len(tc.want) {
+			t.Fatalf("unexpected number of targets, wanted %v, got %v", len(tc.want), len(targets))
+		}
+		for i, want := range tc.want {
+			got := targets[i]
+			if got.URL.String() != want.url {
+				t.Fatalf("unexpected url, wanted %v, got %v", want.url, got.URL)
+			}
+			if len(got.Labels) != len(want.labels) {
+				t.Fatalf("unexpected labels, wanted %v, got %v", want.labels, got.Labels)
+			}
+			for j := range got.Labels {
+				if got.Labels[j] != want.labels[j] {
+					t.Fatalf("unexpected labels, wanted %v, got %v", want.labels, got.Labels)
+				}
+			}
+		}
+	}
+}
+
+func Test_TargetsFromGroups(t *testing.T) {
+	c, err := config.Load([]byte(`
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["static:9100"]
+    relabel_configs:
+      - source_labels: [__meta_filepath]
+        target_label: source
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	groups := map[string][]*discovery.Group{
+		"node": {
+			{
+				Source: "nodes.json:0",
+				Targets: []map[string]string{
+					{"__address__": "a:9100"},
+					{"__address__": "b:9100", "env": "dev"},
+				},
+				Labels: map[string]string{"__meta_filepath": "nodes.json", "env": "prod"},
+			},
+		},
+		"unknown": {
+			{Source: "other.json:0", Targets: []map[string]string{{"__address__": "c:9100"}}},
+		},
+	}
+
+	want := [][]api.Label{
+		{{Name: "job", Value: "node"}, {Name: "instance", Value: "static:9100"}},
+		{{Name: "job", Value: "node"}, {Name: "env", Value: "prod"}, {Name: "source", Value: "nodes.json"}, {Name: "instance", Value: "a:9100"}},
+		{{Name: "job", Value: "node"}, {Name: "env", Value: "dev"}, {Name: "source", Value: "nodes.json"}, {Name: "instance", Value: "b:9100"}},
+	}
+
+	targets := TargetsFromConfig(c, groups)
+	if len(targets) != len(want) {
+		t.Fatalf("unexpected number of targets, wanted %v, got %v", len(want), len(targets))
+	}
+	for i := range targets {
+		if len(targets[i].Labels) != len(want[i]) {
+			t.Fatalf("unexpected labels, wanted %v, got %v", want[i], targets[i].Labels)
+		}
+		for j := range want[i] {
+			if targets[i].Labels[j] != want[i][j] {
+				t.Fatalf("unexpected labels, wanted %v, got %v", want[i], targets[i].Labels)
+			}
+		}
+	}
+}
@@ -1,64 +1,326 @@
 package scrape
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"scrape/api"
+	"scrape/pkg/config"
 	"scrape/pkg/ingest"
+	"scrape/pkg/relabel"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// acceptHeader prefers protobuf, then OpenMetrics and falls back to the
+// Prometheus text format
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited,application/openmetrics-text;version=1.0.0;q=0.8,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`
+
+type format int
+
+const (
+	formatText format = iota
+	formatOpenMetrics
+	formatProtobuf
+)
+
 type UrlScaper struct {
+	target         *Target
 	scrapeUrl      *url.URL
 	scrapeInterval time.Duration
 	client         *http.Client
 	wg             *sync.WaitGroup
+	// strict fails the whole scrape on the first malformed line, otherwise
+	// malformed lines are skipped and reported as diagnostics
+	strict           bool
+	mutex            sync.Mutex
+	diagnostics      []ingest.Diagnostic
+	diagnosticsTotal int
+	health           health
+	// series seen in the last successful scrape
+	series map[string][]api.Label
+	// series written by the last scrape, successful or not, that have not
+	// been marked stale yet, nil before the first scrape
+	written map[string][]api.Label
+	// removed is set when the target is gone for good rather than stopped
+	removed bool
+	// previous is the scraper this one replaces, its series are taken over
+	// once it stopped
+	previous *UrlScaper
+	// stopped is closed once the scraper stopped
+	stopped chan bool
 }
 
-func NewUrlScaper(u *url.URL, wg *sync.WaitGroup) (*UrlScaper, error) {
-	client := http.Client{}
+func NewUrlScaper(target *Target, strict bool, wg *sync.WaitGroup) (*UrlScaper, error) {
+	client, err := config.NewHTTPClient(target.HTTPClientConfig)
+	if err != nil {
+		return nil, err
+	}
 	wg.Add(1)
 	return &UrlScaper{
-		scrapeUrl: u,
-		client:    &client,
-		wg:        wg,
+		target:         target,
+		scrapeUrl:      target.URL,
+		scrapeInterval: target.Interval,
+		client:         client,
+		wg:             wg,
+		strict:         strict,
+		series:         map[string][]api.Label{},
+		health:         health{health: HealthUnknown},
+		stopped:        make(chan bool),
 	}, nil
 }
 
-func (s *UrlScaper) parseResponse(response []byte, samples chan<- api.Sample) error {
-	scanner := ingest.NewScanner()
-	tokens, err := scanner.Scan(string(response))
-	if err != nil {
-		return err
+// withTargetLabels attaches the labels of the target to the exposed labels. On
+// a conflict the exposed label is kept if the target honors labels, otherwise
+// it is renamed with an exported_ prefix.
+func (s *UrlScaper) withTargetLabels(labels []api.Label) []api.Label {
+	targetLabels := s.target.labelSet()
+	result := make([]api.Label, 0, len(labels)+len(targetLabels))
+
+	exposed := map[string]bool{}
+	for _, label := range labels {
+		exposed[label.Name] = true
 	}
 
-	parser := ingest.NewParser(tokens)
-	parsedSamples, err := parser.Parse()
+	if s.target.HonorLabels {
+		result = append(result, labels...)
+		for _, label := range targetLabels {
+			if !exposed[label.Name] {
+				result = append(result, label)
+			}
+		}
+		return result
+	}
+
+	conflicts := map[string]bool{}
+	for _, label := range targetLabels {
+		conflicts[label.Name] = true
+	}
+	for _, label := range labels {
+		if conflicts[label.Name] {
+			name := "exported_" + label.Name
+			for exposed[name] || conflicts[name] {
+				name = "exported_" + name
+			}
+			exposed[name] = true
+			label.Name = name
+		}
+		result = append(result, label)
+	}
+	return append(result, targetLabels...)
+}
+
+// relabel attaches the target labels and applies the metric relabel configs of
+// the target, it returns false if the sample is dropped
+func (s *UrlScaper) relabel(labels []api.Label) ([]api.Label, bool) {
+	return relabel.Process(s.withTargetLabels(labels), s.target.MetricRelabelConfigs...)
+}
+
+// Diagnostics returns the lines skipped in the last scrape
+func (s *UrlScaper) Diagnostics() []ingest.Diagnostic {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.diagnostics
+}
+
+// DiagnosticsTotal returns the number of lines skipped since the scraper was
+// created
+func (s *UrlScaper) DiagnosticsTotal() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.diagnosticsTotal
+}
+
+// LastError returns why the last scrape failed, nil if it succeeded
+func (s *UrlScaper) LastError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.health.lastError
+}
+
+func (s *UrlScaper) updateHealth(start time.Time, duration time.Duration, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.health.update(start, duration, err)
+}
+
+// markRemoved makes the scraper mark the series of its target stale once it is
+// stopped
+func (s *UrlScaper) markRemoved() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removed = true
+}
+
+func (s *UrlScaper) isRemoved() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.removed
+}
+
+func (s *UrlScaper) setDiagnostics(diagnostics []ingest.Diagnostic) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.diagnostics = diagnostics
+	s.diagnosticsTotal += len(diagnostics)
+}
+
+// responseFormat picks the exposition format from the Content-Type header, anything
+// unknown is treated as Prometheus text format
+func responseFormat(contentType string) format {
+	mediaType, params, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return err
+		return formatText
+	}
+	switch mediaType {
+	case "application/openmetrics-text":
+		return formatOpenMetrics
+	case "application/vnd.google.protobuf":
+		if params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited" {
+			return formatProtobuf
+		}
 	}
+	return formatText
+}
 
-	for _, sample := range parsedSamples {
-		samples <- sample
+// streamParser is implemented by the text and protobuf stream parsers
+type streamParser interface {
+	Stream(onSample func(api.Sample) error, onFamily func(api.Family) error) error
+	SetLenient(lenient bool)
+	Diagnostics() []ingest.Diagnostic
+}
+
+func newStreamParser(body io.Reader, contentType string) streamParser {
+	switch responseFormat(contentType) {
+	case formatProtobuf:
+		return ingest.NewProtobufParser(body)
+	case formatOpenMetrics:
+		return ingest.NewOpenMetricsStreamParser(body)
+	default:
+		return ingest.NewStreamParser(body)
 	}
+}
 
-	return nil
+// parseResponse writes the samples and families of the response body to the
+// batch of the report, they are only committed once the whole scrape succeeded
+func (s *UrlScaper) parseResponse(body io.Reader, contentType string, report *scrapeReport) error {
+	parser := newStreamParser(body, contentType)
+	parser.SetLenient(!s.strict)
+	// samples without a timestamp share the one of the scrape, like the
+	// synthetic series and the staleness markers
+	timestamp := api.Timestamp(report.timestamp)
+	// keep adds a sample kept by relabeling to the report and enforces the
+	// limits of the target
+	keep := func(labels []api.Label) error {
+		report.add(labels)
+		err := s.target.Limits.checkLabels(labels)
+		if err != nil {
+			return err
+		}
+		return s.target.Limits.checkSamples(report.postRelabeling)
+	}
+
+	err := parser.Stream(func(sample api.Sample) error {
+		report.scraped++
+		labels, kept := s.relabel(sample.Labels)
+		if !kept {
+			return nil
+		}
+		sample.Labels = labels
+		if sample.Timestamp == nil {
+			sample.Timestamp = timestamp
+		}
+		err := keep(sample.Labels)
+		if err != nil {
+			return err
+		}
+		report.write(sample)
+		return nil
+	}, func(family api.Family) error {
+		// histograms and summaries are relabeled as a whole, their labels
+		// carry the family name but not the le and quantile labels
+		var histograms []api.Histogram
+		for _, histogram := range family.Histograms {
+			report.scraped += len(histogram.Samples(family.Name))
+			labels, kept := s.relabel(histogram.Labels)
+			if !kept {
+				continue
+			}
+			histogram.Labels = labels
+			if histogram.Timestamp == nil {
+				histogram.Timestamp = timestamp
+			}
+			for _, sample := range histogram.Samples(family.Name) {
+				err := keep(sample.Labels)
+				if err != nil {
+					return err
+				}
+			}
+			histograms = append(histograms, histogram)
+		}
+		family.Histograms = histograms
+
+		var summaries []api.Summary
+		for _, summary := range family.Summaries {
+			report.scraped += len(summary.Samples(family.Name))
+			labels, kept := s.relabel(summary.Labels)
+			if !kept {
+				continue
+			}
+			summary.Labels = labels
+			if summary.Timestamp == nil {
+				summary.Timestamp = timestamp
+			}
+			for _, sample := range summary.Samples(family.Name) {
+				err := keep(sample.Labels)
+				if err != nil {
+					return err
+				}
+			}
+			summaries = append(summaries, summary)
+		}
+		family.Summaries = summaries
+
+		report.writeFamily(family)
+		return nil
+	})
+
+	diagnostics := parser.Diagnostics()
+	s.setDiagnostics(diagnostics)
+	for _, diagnostic := range diagnostics {
+		log.Printf("[scrape] skipped malformed line from %v: %v", s.scrapeUrl, diagnostic)
+	}
+
+	return err
 }
 
-func (s *UrlScaper) scrapeInternal(samples chan<- api.Sample) error {
-	req, err := http.NewRequest(http.MethodGet, s.scrapeUrl.String(), nil)
+func (s *UrlScaper) scrapeInternal(report *scrapeReport) error {
+	ctx := context.Background()
+	if s.target.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.target.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.scrapeUrl.String(), nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Accept", acceptHeader)
+	req.Header.Set("Accept-Encoding", acceptEncodingHeader)
+	if s.target.Timeout > 0 {
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(s.target.Timeout.Seconds(), 'f', -1, 64))
+	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return err
+		return s.timeout(ctx, err)
 	}
 	defer resp.Body.Close()
 
@@ -66,32 +328,133 @@ func (s *UrlScaper) scrapeInternal(samples chan<- api.Sample) error {
 		return errors.New(fmt.Sprintf("unexpected status, expected 200 got %v", resp.StatusCode))
 	}
 
-	bytes, err := io.ReadAll(resp.Body)
+	decompressed, err := decompress(resp.Body, resp.Header.Get("Content-Encoding"), s.target.Limits.BodySize)
 	if err != nil {
-		return err
+		return s.timeout(ctx, err)
+	}
+	defer decompressed.Close()
+
+	body := newLimitedReader(decompressed, s.target.Limits.BodySize)
+	err = s.parseResponse(body, resp.Header.Get("Content-Type"), report)
+	if err != nil {
+		return s.timeout(ctx, err)
+	}
+	return nil
+}
+
+// timeout replaces the error of a request that ran into the scrape timeout
+func (s *UrlScaper) timeout(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New(fmt.Sprintf("scrape timed out after %v", s.target.Timeout))
 	}
+	return err
+}
+
+// scrapeWithRetries retries a failed scrape with exponential backoff as long as
+// the retry can finish before the deadline. Every attempt starts with a new
+// report and only the report of the last attempt is returned, the batches of
+// failed attempts are rolled back.
+func (s *UrlScaper) scrapeWithRetries(batches chan<- *api.Batch, quit <-chan bool, start time.Time, deadline time.Time) (*scrapeReport, error) {
+	report := newScrapeReport(batches, start)
+	err := s.scrapeInternal(report)
+	for retry := 0; err != nil && retry < s.target.Retries; retry++ {
+		backoff := retryBackoff(s.target.RetryBackoff, retry)
+		if time.Now().Add(backoff + s.target.Timeout).After(deadline) {
+			break
+		}
+		log.Printf("[scrape] scraping %v failed, retrying in %v: %v", s.scrapeUrl, backoff, err)
+		report.discard()
+		select {
+		case <-quit:
+			return report, err
+		case <-time.After(backoff):
+		}
+		report = newScrapeReport(batches, start)
+		err = s.scrapeInternal(report)
+	}
+	return report, err
+}
+
+func (s *UrlScaper) scrape(samples chan<- api.Sample, batches chan<- *api.Batch, quit <-chan bool) {
+	start := time.Now()
+	deadline := nextScrape(start, s.scrapeInterval, offset(s.target))
+	report, err := s.scrapeWithRetries(batches, quit, start, deadline)
+	elapsed := time.Since(start)
+	s.updateHealth(start, elapsed, err)
+	if err != nil {
+		log.Printf("[scrape] scraping %v failed: %v", s.scrapeUrl, err)
+		// a scrape is written as a whole or not at all
+		report.discard()
+	} else {
+		log.Printf("[scrape] scraping %v succeeded in %vms", s.scrapeUrl, elapsed.Milliseconds())
+		report.finish(true)
+	}
+
+	for _, sample := range s.reportSamples(start, elapsed, err, report) {
+		samples <- sample
+	}
+	// series that are gone, including all series of a target that is down,
+	// are marked stale at the start of the scrape
+	for _, sample := range staleSamples(s.written, report.series, start.UnixMilli()) {
+		samples <- sample
+	}
+	s.written = report.series
+	if err == nil {
+		s.series = report.series
+	}
+}
 
-	return s.parseResponse(bytes, samples)
+// markStale writes staleness markers for all series of the target, including
+// the synthetic ones, if it has been scraped
+func (s *UrlScaper) markStale(samples chan<- api.Sample) {
+	if s.written == nil {
+		return
+	}
+	now := time.Now()
+	for _, sample := range staleSamples(s.written, nil, now.UnixMilli()) {
+		samples <- sample
+	}
+	for _, sample := range s.reportSamples(now, 0, nil, newScrapeReport(nil, now)) {
+		sample.Value = api.StaleNaN
+		samples <- sample
+	}
+	s.written = nil
 }
 
-func (s *UrlScaper) Scrape(samples chan<- api.Sample, quit <-chan bool, tick <-chan bool) {
+// Scrape scrapes the target once per interval until quit is closed. Scrapes are
+// aligned to the interval and offset by a hash of the target, scrapes that
+// were missed because the previous one took too long are skipped.
+func (s *UrlScaper) Scrape(samples chan<- api.Sample, batches chan<- *api.Batch, quit <-chan bool) {
 	go func() {
-		for true {
+		defer s.wg.Done()
+		defer close(s.stopped)
+
+		// a scrape of the previous scraper may still be in progress
+		if s.previous != nil {
+			<-s.previous.stopped
+			s.written = s.previous.written
+			s.series = s.previous.series
+			s.previous = nil
+		}
+
+		next := nextScrape(time.Now(), s.scrapeInterval, offset(s.target))
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+
+		for {
 			select {
 			case <-quit:
-				log.Print("[scrape] quit signal received")
-				s.wg.Done()
-				break
-			case <-tick:
-				start := time.Now()
-				err := s.scrapeInternal(samples)
-				elapsed := time.Since(start)
-				if err != nil {
-					log.Printf("[scrape] scraping %v failed", s.scrapeUrl)
-				} else {
-					log.Printf("[scrape] scraping %v succeeded in %vms", s.scrapeUrl, elapsed.Milliseconds())
+				// stopping all scrapers on shutdown keeps the series, they
+				// are only marked stale if the target was removed
+				if s.isRemoved() {
+					s.markStale(samples)
 				}
-				time.Sleep(s.scrapeInterval)
+				log.Printf("[scrape] stopped scraping %v", s.scrapeUrl)
+				return
+			case <-timer.C:
+				s.scrape(samples, batches, quit)
+				next = nextScrape(time.Now(), s.scrapeInterval, offset(s.target))
+				timer.Reset(time.Until(next))
 			}
 		}
 	}()
@@ -0,0 +1,1048 @@
+package scrape
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"scrape/api"
+	"scrape/pkg/relabel"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func protobufBody(t *testing.T) string {
+	buf := &bytes.Buffer{}
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("up"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			},
+		},
+		{
+			Name: proto.String("requests_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Counter: &dto.Counter{Value: proto.Float64(0.1)}},
+			},
+		},
+	}
+	for _, mf := range families {
+		_, err := protodelim.MarshalTo(buf, mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+// testBatches writes the batches of scrapes like the store does, the samples and
+// families of committed batches are sent to samples and families
+func testBatches(samples chan api.Sample, families chan api.Family) chan *api.Batch {
+	batches := make(chan *api.Batch)
+	go func() {
+		for batch := range batches {
+			var pendingSamples []api.Sample
+			var pendingFamilies []api.Family
+			for done := false; !done; {
+				select {
+				case sample := <-batch.Samples:
+					pendingSamples = append(pendingSamples, sample)
+				case family := <-batch.Families:
+					pendingFamilies = append(pendingFamilies, family)
+				case commit := <-batch.Commit:
+					if commit {
+						for _, sample := range pendingSamples {
+							samples <- sample
+						}
+						for _, family := range pendingFamilies {
+							families <- family
+						}
+					}
+					close(batch.Done)
+					done = true
+				}
+			}
+		}
+	}()
+	return batches
+}
+
+// isReportSample returns true for the synthetic series written on every scrape
+func isReportSample(sample api.Sample) bool {
+	for _, label := range sample.Labels {
+		if label.Name == "__name__" {
+			return label.Value == "up" || strings.HasPrefix(label.Value, "scrape_")
+		}
+	}
+	return false
+}
+
+func Test_UrlScraperContentNegotiation(t *testing.T) {
+	type testcase struct {
+		contentType string
+		body        string
+		wantError   bool
+		wantSamples int
+	}
+
+	testcases := []testcase{
+		{
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			body:        "# TYPE up gauge\nup 1\n# EOF\n",
+			wantError:   false,
+			wantSamples: 1,
+		},
+		{
+			// text format has no # EOF
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			body:        "up 1\n",
+			wantError:   true,
+		},
+		{
+			contentType: "text/plain; version=0.0.4",
+			body:        "# a comment\nup 1\n",
+			wantError:   false,
+			wantSamples: 1,
+		},
+		{
+			contentType: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+			body:        protobufBody(t),
+			wantError:   false,
+			wantSamples: 2,
+		},
+	}
+
+	for _, tc := range testcases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+				t.Errorf("unexpected accept header: %v", r.Header.Get("Accept"))
+			}
+			w.Header().Set("Content-Type", tc.contentType)
+			w.Write([]byte(tc.body))
+		}))
+
+		u, _ := url.Parse(server.URL)
+		scraper, err := NewUrlScaper(&Target{URL: u}, true, &sync.WaitGroup{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples := make(chan api.Sample, 16)
+		report := newScrapeReport(testBatches(samples, make(chan api.Family, 16)), time.Now())
+		err = scraper.scrapeInternal(report)
+		report.finish(err == nil)
+		server.Close()
+
+		if tc.wantError {
+			if err == nil {
+				t.Fatalf("expected error for %v", tc.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(samples) != tc.wantSamples {
+			t.Fatalf("unexpected number of samples, wanted %v, got %v", tc.wantSamples, len(samples))
+		}
+	}
+}
+
+func Test_UrlScraperDiagnostics(t *testing.T) {
+	body := `up 1
+up{a="b"} one
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+other 2
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// strict mode discards the whole scrape, including the samples before the
+	// malformed line
+	strict, err := NewUrlScaper(&Target{URL: u}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make(chan api.Sample, 16)
+	strict.scrape(samples, testBatches(samples, make(chan api.Family, 16)), nil)
+	close(samples)
+	if strict.LastError() == nil {
+		t.Fatalf("expected error in strict mode")
+	}
+	for sample := range samples {
+		if !isReportSample(sample) {
+			t.Fatalf("unexpected sample in strict mode %v", sample)
+		}
+	}
+
+	lenient, err := NewUrlScaper(&Target{URL: u}, false, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		samples := make(chan api.Sample, 16)
+		report := newScrapeReport(testBatches(samples, make(chan api.Family, 16)), time.Now())
+		err = lenient.scrapeInternal(report)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		report.finish(true)
+		if len(samples) != 2 {
+			t.Fatalf("unexpected number of samples, wanted 2, got %v", len(samples))
+		}
+	}
+
+	diagnostics := lenient.Diagnostics()
+	if len(diagnostics) != 2 {
+		t.Fatalf("unexpected number of diagnostics, wanted 2, got %v", diagnostics)
+	}
+	if diagnostics[0].Line != 1 || diagnostics[0].Token != "one" {
+		t.Fatalf("unexpected diagnostic %v", diagnostics[0])
+	}
+	if diagnostics[1].Line != 3 || diagnostics[1].Token != "latency" {
+		t.Fatalf("unexpected diagnostic %v", diagnostics[1])
+	}
+	if lenient.DiagnosticsTotal() != 4 {
+		t.Fatalf("unexpected number of total diagnostics, wanted 4, got %v", lenient.DiagnosticsTotal())
+	}
+	state := lenient.State()
+	if len(state.Diagnostics) != 2 || state.DiagnosticsTotal != 4 {
+		t.Fatalf("unexpected diagnostics in target state %+v", state)
+	}
+}
+
+func Test_UrlScraperReport(t *testing.T) {
+	type testcase struct {
+		status      int
+		body        string
+		wantUp      float64
+		wantScraped float64
+		wantAdded   float64
+	}
+
+	testcases := []testcase{
+		{
+			status:      200,
+			body:        "# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\nlatency_bucket{le=\"+Inf\"} 2\nlatency_sum 3\nlatency_count 2\nup 1\n",
+			wantUp:      1,
+			wantScraped: 5,
+			wantAdded:   5,
+		},
+		{
+			status:      200,
+			body:        "up 1\nother 2\n",
+			wantUp:      1,
+			wantScraped: 2,
+			wantAdded:   1,
+		},
+		{
+			status: 500,
+			wantUp: 0,
+		},
+		{
+			// failed scrapes do not replace the series of the last scrape
+			status:      200,
+			body:        "up 1\nother 2\n",
+			wantUp:      1,
+			wantScraped: 2,
+			wantAdded:   0,
+		},
+	}
+
+	var current testcase
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(current.status)
+		w.Write([]byte(current.body))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	scraper, err := NewUrlScaper(&Target{Job: "node", URL: u}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range testcases {
+		current = tc
+		samples := make(chan api.Sample, 16)
+		scraper.scrape(samples, testBatches(samples, make(chan api.Family, 16)), nil)
+		close(samples)
+
+		values := map[string]float64{}
+		for sample := range samples {
+			labels := map[string]string{}
+			for _, label := range sample.Labels {
+				labels[label.Name] = label.Value
+			}
+			if labels["job"] != "node" || labels["instance"] != u.Host {
+				t.Fatalf("missing target labels %v", sample.Labels)
+			}
+			// the exposed up series is marked stale once the target is down
+			if api.IsStaleNaN(sample.Value) {
+				continue
+			}
+			if labels["__name__"] == "up" || strings.HasPrefix(labels["__name__"], "scrape_") {
+				values[labels["__name__"]] = sample.Value
+			}
+		}
+
+		if len(values) != 5 {
+			t.Fatalf("unexpected synthetic series %v", values)
+		}
+		if values["up"] != tc.wantUp {
+			t.Fatalf("unexpected up, wanted %v, got %v", tc.wantUp, values["up"])
+		}
+		if values["scrape_samples_scraped"] != tc.wantScraped || values["scrape_samples_post_metric_relabeling"] != tc.wantScraped {
+			t.Fatalf("unexpected number of scraped samples, wanted %v, got %v", tc.wantScraped, values)
+		}
+		if values["scrape_series_added"] != tc.wantAdded {
+			t.Fatalf("unexpected number of added series, wanted %v, got %v", tc.wantAdded, values["scrape_series_added"])
+		}
+		if values["scrape_duration_seconds"] <= 0 {
+			t.Fatalf("unexpected scrape duration %v", values["scrape_duration_seconds"])
+		}
+	}
+}
+
+func Test_UrlScraperStaleness(t *testing.T) {
+	type testcase struct {
+		status    int
+		body      string
+		wantStale []string
+	}
+
+	testcases := []testcase{
+		{
+			status: 200,
+			body:   "a 1\nb 1\nc 1\n",
+		},
+		{
+			status:    200,
+			body:      "a 1\nc 1\n",
+			wantStale: []string{"b"},
+		},
+		{
+			// all series of a target that is down are stale
+			status:    500,
+			wantStale: []string{"a", "c"},
+		},
+		{
+			status: 500,
+		},
+		{
+			status: 200,
+			body:   "a 1\n",
+		},
+	}
+
+	var current testcase
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(current.status)
+		w.Write([]byte(current.body))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	scraper, err := NewUrlScaper(&Target{Job: "node", URL: u}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stale returns the names of the series marked stale
+	stale := func(samples chan api.Sample) map[string]bool {
+		close(samples)
+		names := map[string]bool{}
+		for sample := range samples {
+			if !api.IsStaleNaN(sample.Value) {
+				continue
+			}
+			for _, label := range sample.Labels {
+				if label.Name == "__name__" {
+					names[label.Value] = true
+				}
+			}
+		}
+		return names
+	}
+
+	for i, tc := range testcases {
+		current = tc
+		samples := make(chan api.Sample, 16)
+		scraper.scrape(samples, testBatches(samples, make(chan api.Family, 16)), nil)
+
+		got := stale(samples)
+		if len(got) != len(tc.wantStale) {
+			t.Fatalf("scrape %v: unexpected stale series, wanted %v, got %v", i, tc.wantStale, got)
+		}
+		for _, name := range tc.wantStale {
+			if !got[name] {
+				t.Fatalf("scrape %v: unexpected stale series, wanted %v, got %v", i, tc.wantStale, got)
+			}
+		}
+	}
+
+	// removing the target marks its series and the synthetic ones stale
+	samples := make(chan api.Sample, 16)
+	scraper.markStale(samples)
+	got := stale(samples)
+	if !got["a"] || !got["up"] || len(got) != 6 {
+		t.Fatalf("unexpected stale series after removal %v", got)
+	}
+}
+
+func Test_UrlScraperTimestamps(t *testing.T) {
+	bodies := []string{
+		"a 1\nb 2 1697000000000\n# TYPE latency summary\nlatency_sum 1\nlatency_count 2\n",
+		// a and latency are marked stale at the timestamp of the scrape
+		"b 2 1697000000000\n",
+	}
+
+	var current string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(current))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	scraper, err := NewUrlScaper(&Target{Job: "node", URL: u}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, body := range bodies {
+		current = body
+		samples := make(chan api.Sample, 32)
+		families := make(chan api.Family, 16)
+		scraper.scrape(samples, testBatches(samples, families), nil)
+		close(samples)
+		close(families)
+
+		var written []api.Sample
+		var up *int64
+		stale := 0
+		for sample := range samples {
+			if sample.Labels[0].Value == "up" {
+				up = sample.Timestamp
+			}
+			if api.IsStaleNaN(sample.Value) {
+				stale++
+			}
+			written = append(written, sample)
+		}
+		if up == nil {
+			t.Fatalf("scrape %v: missing up sample", i)
+		}
+		if stale != 3*i {
+			t.Fatalf("scrape %v: unexpected number of staleness markers, wanted %v, got %v", i, 3*i, stale)
+		}
+
+		// only samples exposed with a timestamp keep their own
+		for _, sample := range written {
+			want := *up
+			if sample.Labels[0].Value == "b" {
+				want = 1697000000000
+			}
+			if sample.Timestamp == nil || *sample.Timestamp != want {
+				t.Fatalf("scrape %v: unexpected timestamp of %v, wanted %v", i, sample, want)
+			}
+		}
+		for family := range families {
+			for _, summary := range family.Summaries {
+				if summary.Timestamp == nil || *summary.Timestamp != *up {
+					t.Fatalf("scrape %v: unexpected timestamp of summary %v, wanted %v", i, summary, *up)
+				}
+			}
+		}
+	}
+}
+
+func Test_UrlScraperStreaming(t *testing.T) {
+	// the rest of the body is only sent once the first sample reached the store
+	received := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a 1\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Errorf("first sample was not written while the body was read")
+		}
+		w.Write([]byte("b 1\n"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	scraper, err := NewUrlScaper(&Target{Job: "node", URL: u}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := make(chan *api.Batch)
+	written := 0
+	go func() {
+		batch := <-batches
+		for {
+			select {
+			case <-batch.Samples:
+				written++
+				if written == 1 {
+					close(received)
+				}
+			case commit := <-batch.Commit:
+				if !commit {
+					t.Errorf("batch of a successful scrape was rolled back")
+				}
+				close(batch.Done)
+				return
+			}
+		}
+	}()
+	scraper.scrape(make(chan api.Sample, 16), batches, nil)
+
+	if scraper.LastError() != nil || written != 2 {
+		t.Fatalf("unexpected scrape of %v samples: %v", written, scraper.LastError())
+	}
+}
+
+func Test_UrlScraperHealth(t *testing.T) {
+	type testcase struct {
+		// failures is the number of requests that fail before the target
+		// responds again
+		failures     int
+		retries      int
+		wantHealth   Health
+		wantRequests int
+		wantFailures int
+	}
+
+	testcases := []testcase{
+		{
+			failures:     0,
+			wantHealth:   HealthUp,
+			wantRequests: 1,
+		},
+		{
+			failures:     1,
+			wantHealth:   HealthDown,
+			wantRequests: 1,
+			wantFailures: 1,
+		},
+		{
+			// retries recover from failures within the interval
+			failures:     2,
+			retries:      3,
+			wantHealth:   HealthUp,
+			wantRequests: 3,
+		},
+		{
+			failures:     5,
+			retries:      2,
+			wantHealth:   HealthDown,
+			wantRequests: 3,
+			wantFailures: 1,
+		},
+		{
+			// the backoff of the fourth retry exceeds the interval
+			failures:     10,
+			retries:      5,
+			wantHealth:   HealthDown,
+			wantRequests: 4,
+			wantFailures: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= tc.failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("up 1\n"))
+		}))
+		u, _ := url.Parse(server.URL)
+
+		scraper, err := NewUrlScaper(&Target{
+			Job:          "node",
+			URL:          u,
+			Interval:     time.Second,
+			Timeout:      100 * time.Millisecond,
+			Retries:      tc.retries,
+			RetryBackoff: 100 * time.Millisecond,
+		}, true, &sync.WaitGroup{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scraper.State().Health != HealthUnknown {
+			t.Fatalf("unexpected health before the first scrape %v", scraper.State().Health)
+		}
+
+		// scrape right at the start of the interval to leave room for retries
+		time.Sleep(time.Until(nextScrape(time.Now(), time.Second, offset(scraper.target))))
+		samples := make(chan api.Sample, 64)
+		scraper.scrape(samples, testBatches(samples, make(chan api.Family, 16)), nil)
+		server.Close()
+
+		state := scraper.State()
+		if state.Health != tc.wantHealth || requests != tc.wantRequests || state.ConsecutiveFailures != tc.wantFailures {
+			t.Fatalf("unexpected state %+v after %v requests", state, requests)
+		}
+		if (state.LastError != "") != (tc.wantHealth == HealthDown) {
+			t.Fatalf("unexpected last error %q", state.LastError)
+		}
+		if state.LastScrape.IsZero() || state.LastScrapeDuration <= 0 {
+			t.Fatalf("unexpected last scrape %v, %v", state.LastScrape, state.LastScrapeDuration)
+		}
+	}
+}
+
+func Test_UrlScraperRetries(t *testing.T) {
+	type testcase struct {
+		// responses are the bodies of the attempts of a scrape, an empty body
+		// fails with a 503
+		responses []string
+		wantError bool
+		wantNames []string
+		wantStale []string
+	}
+
+	testcases := []testcase{
+		{
+			// the first attempt breaks off after b, its samples are discarded
+			responses: []string{"a 1\nb 1\n", "a 1\nc 1\n"},
+			wantNames: []string{"a", "c"},
+		},
+		{
+			// b was never written, so only a and c are marked stale
+			responses: []string{"", ""},
+			wantError: true,
+			wantStale: []string{"a", "c"},
+		},
+	}
+
+	var responses []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := responses[0]
+		responses = responses[1:]
+		if body == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if len(responses) > 0 {
+			// announce more than is sent to fail the attempt halfway
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)+100))
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	scraper, err := NewUrlScaper(&Target{
+		Job:          "node",
+		URL:          u,
+		Interval:     time.Second,
+		Timeout:      100 * time.Millisecond,
+		Retries:      1,
+		RetryBackoff: 10 * time.Millisecond,
+	}, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range testcases {
+		responses = tc.responses
+		samples := make(chan api.Sample, 64)
+		time.Sleep(time.Until(nextScrape(time.Now(), time.Second, offset(scraper.target))))
+		scraper.scrape(samples, testBatches(samples, make(chan api.Family, 16)), nil)
+		close(samples)
+
+		if (scraper.LastError() != nil) != tc.wantError {
+			t.Fatalf("scrape %v: unexpected error %v", i, scraper.LastError())
+		}
+		var names, stale []string
+		for sample := range samples {
+			if isReportSample(sample) {
+				continue
+			}
+			name := sample.Labels[0].Value
+			if api.IsStaleNaN(sample.Value) {
+				stale = append(stale, name)
+			} else {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(stale)
+		if fmt.Sprint(names) != fmt.Sprint(tc.wantNames) || fmt.Sprint(stale) != fmt.Sprint(tc.wantStale) {
+			t.Fatalf("scrape %v: unexpected samples %v and stale series %v", i, names, stale)
+		}
+	}
+}
+
+func Test_UrlScraperTargetLabels(t *testing.T) {
+	type testcase struct {
+		honorLabels bool
+		static      []api.Label
+		labels      []api.Label
+		want        []api.Label
+	}
+
+	testcases := []testcase{
+		{
+			labels: []api.Label{{Name: "__name__", Value: "up"}},
+			want: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "node"},
+				{Name: "instance", Value: "host:9100"},
+			},
+		},
+		{
+			static: []api.Label{{Name: "env", Value: "prod"}, {Name: "instance", Value: "primary"}},
+			labels: []api.Label{{Name: "__name__", Value: "up"}},
+			want: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "node"},
+				{Name: "instance", Value: "primary"},
+				{Name: "env", Value: "prod"},
+			},
+		},
+		{
+			labels: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "exposed"},
+				{Name: "exported_job", Value: "taken"},
+			},
+			want: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "exported_exported_job", Value: "exposed"},
+				{Name: "exported_job", Value: "taken"},
+				{Name: "job", Value: "node"},
+				{Name: "instance", Value: "host:9100"},
+			},
+		},
+		{
+			honorLabels: true,
+			labels: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "exposed"},
+			},
+			want: []api.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "exposed"},
+				{Name: "instance", Value: "host:9100"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		target := &Target{
+			Job:         "node",
+			URL:         &url.URL{Scheme: "http", Host: "host:9100", Path: "/metrics"},
+			Labels:      tc.static,
+			HonorLabels: tc.honorLabels,
+		}
+		scraper, err := NewUrlScaper(target, true, &sync.WaitGroup{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := scraper.withTargetLabels(tc.labels)
+		if len(got) != len(tc.want) {
+			t.Fatalf("unexpected labels, wanted %v, got %v", tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("unexpected labels, wanted %v, got %v", tc.want, got)
+			}
+		}
+	}
+}
+
+func Test_UrlScraperMetricRelabeling(t *testing.T) {
+	body := `# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} 0.1
+go_gc_duration_seconds_sum 1
+go_gc_duration_seconds_count 10
+go_goroutines 12
+http_requests_total{code="200",pod_template_hash="abc"} 3
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	target := &Target{
+		Job: "app",
+		URL: u,
+		MetricRelabelConfigs: []*relabel.Config{
+			{SourceLabels: []string{"__name__"}, Regex: relabel.MustNewRegexp("go_gc_.*"), Action: relabel.Drop},
+			{Regex: relabel.MustNewRegexp("pod_template_hash"), Action: relabel.LabelDrop},
+		},
+	}
+	scraper, err := NewUrlScaper(target, true, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(chan api.Sample, 16)
+	families := make(chan api.Family, 16)
+	report := newScrapeReport(testBatches(samples, families), time.Now())
+	err = scraper.scrapeInternal(report)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report.finish(true)
+	close(samples)
+	close(families)
+
+	var names []string
+	for sample := range samples {
+		for _, label := range sample.Labels {
+			if label.Name == "pod_template_hash" {
+				t.Fatalf("label was not dropped: %v", sample.Labels)
+			}
+			if label.Name == "__name__" {
+				names = append(names, label.Value)
+			}
+		}
+	}
+	if len(names) != 2 || names[0] != "go_goroutines" || names[1] != "http_requests_total" {
+		t.Fatalf("unexpected samples %v", names)
+	}
+	for family := range families {
+		if len(family.Summaries) != 0 {
+			t.Fatalf("summary was not dropped: %v", family)
+		}
+	}
+
+	if report.scraped != 5 || report.postRelabeling != 2 {
+		t.Fatalf("unexpected report, wanted 5 scraped and 2 kept, got %v and %v", report.scraped, report.postRelabeling)
+	}
+}
+
+func Test_UrlScraperLimits(t *testing.T) {
+	type testcase struct {
+		body      string
+		delay     time.Duration
+		timeout   time.Duration
+		limits    Limits
+		wantError string
+	}
+
+	body := "a{x=\"1\"} 1\nb{x=\"22\",y=\"333\"} 2\n"
+	testcases := []testcase{
+		{
+			body: body,
+			limits: Limits{
+				BodySize: int64(len(body)),
+				Samples:  2,
+				Labels:   5,
+			},
+		},
+		{
+			body:      body,
+			limits:    Limits{BodySize: int64(len(body) - 1)},
+			wantError: "body size limit",
+		},
+		{
+			body:      body,
+			limits:    Limits{Samples: 1},
+			wantError: "sample limit of 1 exceeded",
+		},
+		{
+			// job and instance count towards the label limit
+			body:      body,
+			limits:    Limits{Labels: 4},
+			wantError: "label limit of 4 exceeded",
+		},
+		{
+			body:      body,
+			limits:    Limits{LabelNameLength: 7},
+			wantError: "label name length limit",
+		},
+		{
+			body:      body,
+			limits:    Limits{LabelValueLength: 2},
+			wantError: "label value length limit",
+		},
+		{
+			body:      "# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\nlatency_bucket{le=\"+Inf\"} 2\nlatency_sum 3\nlatency_count 2\n",
+			limits:    Limits{Samples: 3},
+			wantError: "sample limit of 3 exceeded",
+		},
+		{
+			body:      body,
+			delay:     200 * time.Millisecond,
+			timeout:   50 * time.Millisecond,
+			wantError: "scrape timed out after 50ms",
+		},
+	}
+
+	for _, tc := range testcases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.timeout > 0 && r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds") != "0.05" {
+				t.Errorf("unexpected timeout header: %v", r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"))
+			}
+			time.Sleep(tc.delay)
+			w.Write([]byte(tc.body))
+		}))
+
+		u, _ := url.Parse(server.URL)
+		scraper, err := NewUrlScaper(&Target{Job: "node", URL: u, Timeout: tc.timeout, Limits: tc.limits}, true, &sync.WaitGroup{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := make(chan api.Sample, 16)
+		families := make(chan api.Family, 16)
+		scraper.scrape(samples, testBatches(samples, families), nil)
+		server.Close()
+		close(samples)
+		close(families)
+
+		err = scraper.LastError()
+		if tc.wantError == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Fatalf("unexpected error, wanted %v, got %v", tc.wantError, err)
+		}
+
+		// samples read before the limit was exceeded are discarded
+		for sample := range samples {
+			if !isReportSample(sample) {
+				t.Fatalf("%v: unexpected sample of a failed scrape %v", tc.wantError, sample)
+			}
+		}
+		if len(families) != 0 {
+			t.Fatalf("%v: unexpected families of a failed scrape", tc.wantError)
+		}
+	}
+}
+
+func compress(t *testing.T, encoding string, body string) []byte {
+	buf := &bytes.Buffer{}
+	var writer io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(buf)
+	case "deflate":
+		writer = zlib.NewWriter(buf)
+	case "raw-deflate":
+		writer, err = flate.NewWriter(buf, flate.DefaultCompression)
+	case "zstd":
+		writer, err = zstd.NewWriter(buf)
+	case "zstd-large-window":
+		writer, err = zstd.NewWriter(buf, zstd.WithWindowSize(1<<20), zstd.WithSingleSegment(false))
+	default:
+		return []byte(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_UrlScraperCompression(t *testing.T) {
+	type testcase struct {
+		encoding        string
+		contentEncoding string
+		body            string
+		bodySizeLimit   int64
+		wantError       string
+		wantSamples     int
+	}
+
+	body := "up 1\nrequests_total 10\n"
+	// a small response decompressing into a large comment
+	bomb := body + "# " + strings.Repeat("0", 1<<20) + "\n"
+
+	testcases := []testcase{
+		{encoding: "identity", body: body, wantSamples: 2},
+		{encoding: "gzip", contentEncoding: "gzip", body: body, wantSamples: 2},
+		{encoding: "deflate", contentEncoding: "deflate", body: body, wantSamples: 2},
+		{encoding: "raw-deflate", contentEncoding: "deflate", body: body, wantSamples: 2},
+		{encoding: "zstd", contentEncoding: "zstd", body: body, wantSamples: 2},
+		{encoding: "identity", contentEncoding: "br", body: body, wantError: "unsupported content encoding"},
+		{encoding: "gzip", contentEncoding: "gzip", body: bomb, bodySizeLimit: 4096, wantError: "body size limit"},
+		{encoding: "zstd", contentEncoding: "zstd", body: bomb, bodySizeLimit: 4096, wantError: "body size limit"},
+		// the decoder does not allocate a window larger than the limit
+		{encoding: "zstd-large-window", contentEncoding: "zstd", body: bomb, bodySizeLimit: 4096, wantError: "zstd window exceeds the body size limit"},
+		{encoding: "zstd-large-window", contentEncoding: "zstd", body: bomb, bodySizeLimit: 2 << 20, wantSamples: 2},
+	}
+
+	for _, tc := range testcases {
+		data := compress(t, tc.encoding, tc.body)
+		if tc.bodySizeLimit > 0 && int64(len(data)) >= tc.bodySizeLimit {
+			t.Fatalf("compressed body of %v bytes does not fit the limit", len(data))
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+				t.Errorf("unexpected accept encoding header: %v", r.Header.Get("Accept-Encoding"))
+			}
+			if tc.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", tc.contentEncoding)
+			}
+			w.Write(data)
+		}))
+
+		u, _ := url.Parse(server.URL)
+		scraper, err := NewUrlScaper(&Target{URL: u, Limits: Limits{BodySize: tc.bodySizeLimit}}, true, &sync.WaitGroup{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := make(chan api.Sample, 16)
+		report := newScrapeReport(testBatches(samples, make(chan api.Family, 16)), time.Now())
+		err = scraper.scrapeInternal(report)
+		report.finish(err == nil)
+		server.Close()
+
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Fatalf("%v: unexpected error, wanted %v, got %v", tc.encoding, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.encoding, err)
+		}
+		if len(samples) != tc.wantSamples {
+			t.Fatalf("%v: unexpected number of samples, wanted %v, got %v", tc.encoding, tc.wantSamples, len(samples))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"scrape/pkg/ingest"
+	"scrape/pkg/scrape"
+	"time"
+)
+
+// Web serves the HTTP endpoints used to control and inspect the process
+type Web struct {
+	mux     *http.ServeMux
+	reload  chan<- chan error
+	quit    <-chan bool
+	targets func() []scrape.TargetState
+}
+
+// NewWeb creates the handler, reload requests are sent to the reload channel
+// along with a channel that receives the outcome of the reload, reloads are
+// disabled if it is nil. Reloads are refused once quit is closed. The targets
+// function returns the state of the targets being scraped.
+func NewWeb(reload chan<- chan error, quit <-chan bool, targets func() []scrape.TargetState) *Web {
+	w := &Web{
+		mux:     http.NewServeMux(),
+		reload:  reload,
+		quit:    quit,
+		targets: targets,
+	}
+	w.mux.HandleFunc("/-/reload", w.handleReload)
+	w.mux.HandleFunc("/api/v1/targets", w.handleTargets)
+	return w
+}
+
+func (w *Web) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mux.ServeHTTP(rw, r)
+}
+
+func (w *Web) handleReload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if w.reload == nil {
+		http.Error(rw, "reload is not enabled", http.StatusForbidden)
+		return
+	}
+
+	// the result is buffered so that the reload does not block on a request
+	// that is gone
+	result := make(chan error, 1)
+	select {
+	case w.reload <- result:
+	case <-w.quit:
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	var err error
+	select {
+	case err = <-result:
+	case <-r.Context().Done():
+		return
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// target is a target as listed by the Prometheus targets API, along with the
+// number of consecutive failures and the lines skipped in lenient mode
+type target struct {
+	ScrapePool          string              `json:"scrapePool"`
+	ScrapeURL           string              `json:"scrapeUrl"`
+	Labels              map[string]string   `json:"labels"`
+	Health              scrape.Health       `json:"health"`
+	LastError           string              `json:"lastError"`
+	LastScrape          time.Time           `json:"lastScrape"`
+	LastScrapeDuration  float64             `json:"lastScrapeDuration"`
+	ScrapeInterval      string              `json:"scrapeInterval"`
+	ScrapeTimeout       string              `json:"scrapeTimeout"`
+	ConsecutiveFailures int                 `json:"consecutiveFailures"`
+	Diagnostics         []ingest.Diagnostic `json:"diagnostics"`
+	DiagnosticsTotal    int                 `json:"diagnosticsTotal"`
+}
+
+type targetsResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ActiveTargets []target `json:"activeTargets"`
+	} `json:"data"`
+}
+
+func (w *Web) handleTargets(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := targetsResponse{Status: "success"}
+	response.Data.ActiveTargets = []target{}
+	for _, state := range w.targets() {
+		diagnostics := state.Diagnostics
+		if diagnostics == nil {
+			diagnostics = []ingest.Diagnostic{}
+		}
+		labels := map[string]string{}
+		for _, label := range state.Labels {
+			labels[label.Name] = label.Value
+		}
+		response.Data.ActiveTargets = append(response.Data.ActiveTargets, target{
+			ScrapePool:          state.Job,
+			ScrapeURL:           state.URL,
+			Labels:              labels,
+			Health:              state.Health,
+			LastError:           state.LastError,
+			LastScrape:          state.LastScrape,
+			LastScrapeDuration:  state.LastScrapeDuration.Seconds(),
+			ScrapeInterval:      state.Interval.String(),
+			ScrapeTimeout:       state.Timeout.String(),
+			ConsecutiveFailures: state.ConsecutiveFailures,
+			Diagnostics:         diagnostics,
+			DiagnosticsTotal:    state.DiagnosticsTotal,
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(response)
+	if err != nil {
+		log.Printf("[web] writing targets failed: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"scrape/api"
+	"scrape/pkg/ingest"
+	"scrape/pkg/scrape"
+	"testing"
+	"time"
+)
+
+func Test_Reload(t *testing.T) {
+	type testcase struct {
+		method     string
+		err        error
+		disabled   bool
+		quit       bool
+		wantReload bool
+		wantStatus int
+	}
+
+	testcases := []testcase{
+		{
+			method:     http.MethodPost,
+			wantReload: true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			method:     http.MethodPost,
+			err:        errors.New("invalid config"),
+			wantReload: true,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			method:     http.MethodPost,
+			disabled:   true,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			// nobody receives reloads after the shutdown
+			method:     http.MethodPost,
+			quit:       true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range testcases {
+		reload := make(chan chan error)
+		reloaded := make(chan bool, 1)
+		if !tc.quit {
+			go func() {
+				for result := range reload {
+					reloaded <- true
+					result <- tc.err
+				}
+			}()
+		}
+		quit := make(chan bool)
+		if tc.quit {
+			close(quit)
+		}
+
+		web := NewWeb(reload, quit, nil)
+		if tc.disabled {
+			web = NewWeb(nil, quit, nil)
+		}
+		recorder := httptest.NewRecorder()
+		web.ServeHTTP(recorder, httptest.NewRequest(tc.method, "/-/reload", nil))
+		close(reload)
+
+		if recorder.Code != tc.wantStatus {
+			t.Fatalf("unexpected status, wanted %v, got %v", tc.wantStatus, recorder.Code)
+		}
+		if (len(reloaded) > 0) != tc.wantReload {
+			t.Fatalf("unexpected reload, wanted %v, got %v", tc.wantReload, len(reloaded) > 0)
+		}
+	}
+}
+
+func Test_Targets(t *testing.T) {
+	lastScrape := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	targets := func() []scrape.TargetState {
+		return []scrape.TargetState{
+			{
+				Job:                 "node",
+				URL:                 "http://a:9100/metrics",
+				Labels:              []api.Label{{Name: "job", Value: "node"}, {Name: "instance", Value: "a:9100"}},
+				Interval:            time.Minute,
+				Timeout:             10 * time.Second,
+				Health:              scrape.HealthDown,
+				LastError:           "connection refused",
+				LastScrape:          lastScrape,
+				LastScrapeDuration:  500 * time.Millisecond,
+				ConsecutiveFailures: 3,
+				Diagnostics:         []ingest.Diagnostic{{Line: 2, Token: "one", Reason: "expected value"}},
+				DiagnosticsTotal:    5,
+			},
+		}
+	}
+
+	type testcase struct {
+		method     string
+		wantStatus int
+	}
+
+	testcases := []testcase{
+		{method: http.MethodGet, wantStatus: http.StatusOK},
+		{method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testcases {
+		recorder := httptest.NewRecorder()
+		NewWeb(nil, nil, targets).ServeHTTP(recorder, httptest.NewRequest(tc.method, "/api/v1/targets", nil))
+		if recorder.Code != tc.wantStatus {
+			t.Fatalf("unexpected status, wanted %v, got %v", tc.wantStatus, recorder.Code)
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var response targetsResponse
+		err := json.NewDecoder(recorder.Body).Decode(&response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != "success" || len(response.Data.ActiveTargets) != 1 {
+			t.Fatalf("unexpected response %+v", response)
+		}
+		got := response.Data.ActiveTargets[0]
+		want := target{
+			ScrapePool:          "node",
+			ScrapeURL:           "http://a:9100/metrics",
+			Labels:              map[string]string{"job": "node", "instance": "a:9100"},
+			Health:              scrape.HealthDown,
+			LastError:           "connection refused",
+			LastScrape:          lastScrape,
+			LastScrapeDuration:  0.5,
+			ScrapeInterval:      "1m0s",
+			ScrapeTimeout:       "10s",
+			ConsecutiveFailures: 3,
+			Diagnostics:         []ingest.Diagnostic{{Line: 2, Token: "one", Reason: "expected value"}},
+			DiagnosticsTotal:    5,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected target, wanted %+v, got %+v", want, got)
+		}
+	}
+}
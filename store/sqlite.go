@@ -6,8 +6,11 @@ import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"math"
 	"scrape/api"
 	"scrape/pkg/promql"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,11 +23,14 @@ create table if not exists 'timeseries' (
 )
 `
 
+// value_bits holds the IEEE 754 bits of values SQLite cannot store as REAL,
+// value is NULL in that case
 const tableSamples = `
 create table if not exists 'samples' (
 	timestamp		INTEGER,
 	timeseries_id	INTEGER,
 	value			REAL,
+	value_bits		INTEGER,
 	UNIQUE(timestamp, timeseries_id)
 )
 `
@@ -44,6 +50,38 @@ create table if not exists 'timeseries_labels' (
 )
 `
 
+const tableMetadata = `
+create table if not exists 'metadata' (
+	name	TEXT PRIMARY KEY,
+	type	TEXT,
+	help	TEXT,
+	unit	TEXT
+)
+`
+
+// migration upgrades the schema by one version
+type migration func(tx *sql.Tx) error
+
+func execMigration(query string) migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// migrations upgrade databases created by older versions, the schema version
+// (stored in user_version) is the number of migrations applied
+var migrations = []migration{
+	// 1: timestamps are stored in milliseconds instead of seconds
+	execMigration(`update samples set timestamp = timestamp * 1000`),
+	// 2: NaN values are stored as raw bits
+	execMigration(`alter table samples add column value_bits INTEGER`),
+	// 3: series are hashed independent of the order of their labels
+	rehashTimeseries,
+	// 4: metadata keeps the unit of OpenMetrics families
+	addMetadataUnit,
+}
+
 type SqliteColumn struct {
 	Name  string
 	Value string
@@ -58,20 +96,119 @@ type SqliteResult struct {
 	Success bool
 }
 
+// SqliteQuery is a query from the interactive prompt, the store sends its
+// result to Result
+type SqliteQuery struct {
+	Query  promql.PromQlASTElement
+	Result chan<- *SqliteResult
+}
+
 type SqliteStore struct {
 	db *sql.DB
 	wg *sync.WaitGroup
 }
 
+// getTimeseries returns the hash identifying the series of the labels, labels
+// are sorted by name and separated so that the order of the labels does not
+// matter and names and values cannot run into each other
 func getTimeseries(labels []api.Label) string {
+	sorted := make([]api.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
 	hf := sha256.New()
-	for _, label := range labels {
+	for _, label := range sorted {
 		hf.Write([]byte(label.Name))
+		hf.Write([]byte{0xff})
 		hf.Write([]byte(label.Value))
+		hf.Write([]byte{0xff})
 	}
 	return fmt.Sprintf("%x", hf.Sum(nil))
 }
 
+// rehashTimeseries recomputes the hashes of all series from their labels. Series
+// that only differed in the order of their labels are merged into the series
+// with the lowest id. Series that collided under the old hash already share an
+// id and cannot be told apart.
+func rehashTimeseries(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+select distinct tl.timeseries_id, l.name, tl.label_value
+from timeseries_labels tl join labels l on l.id = tl.label_id
+order by tl.timeseries_id`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	labels := map[int64][]api.Label{}
+	for rows.Next() {
+		var id int64
+		var label api.Label
+		err = rows.Scan(&id, &label.Name, &label.Value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := labels[id]; !ok {
+			ids = append(ids, id)
+		}
+		labels[id] = append(labels[id], label)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	// the old hashes are replaced by placeholders first so that they cannot
+	// conflict with the new ones
+	_, err = tx.Exec(`update timeseries set hash = 'migrating-' || id`)
+	if err != nil {
+		return err
+	}
+
+	kept := map[string]int64{}
+	for _, id := range ids {
+		hash := getTimeseries(labels[id])
+		keep, ok := kept[hash]
+		if !ok {
+			kept[hash] = id
+			_, err = tx.Exec(`update timeseries set hash = ? where id = ?`, hash, id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, query := range []string{
+			`update or ignore samples set timeseries_id = ? where timeseries_id = ?`,
+			`delete from samples where timeseries_id = ?2`,
+			`delete from timeseries_labels where timeseries_id = ?2`,
+			`delete from timeseries where id = ?2`,
+		} {
+			_, err = tx.Exec(query, keep, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// series without labels keep their placeholder, they cannot be queried
+	return nil
+}
+
+// addMetadataUnit adds the unit column to the metadata table unless the table
+// was only created by this version and already has it
+func addMetadataUnit(tx *sql.Tx) error {
+	var count int
+	err := tx.QueryRow(`select count(*) from pragma_table_info('metadata') where name = 'unit'`).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = tx.Exec(`alter table metadata add column unit TEXT`)
+	return err
+}
+
 func createTables(db *sql.DB) error {
 	_, err := db.Exec(tableTimeseries)
 	if err != nil {
@@ -93,19 +230,106 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(tableMetadata)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var count int
+	err := db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = ?`, name).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func migrate(db *sql.DB, fresh bool) error {
+	var version int
+	err := db.QueryRow(`pragma user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	// new databases are created with the current schema
+	if fresh {
+		version = len(migrations)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := version; i < len(migrations); i++ {
+		log.Printf("[sqlite] migrating schema to version %v", i+1)
+		err = migrations[i](tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", len(migrations)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runQuery evaluates the query at the current time, every sample of the result
+// becomes a row with a column per label followed by the value and timestamp
 func runQuery(db *sql.DB, query promql.PromQlASTElement) *SqliteResult {
 	result := &SqliteResult{}
-	result.Success = true
 
-	query.Eval(db)
+	samples, err := query.Eval(db, time.Now())
+	if err != nil {
+		log.Printf("[sqlite] error running query: %v", err)
+		return result
+	}
 
+	for _, sample := range samples {
+		row := SqliteRow{}
+		row.Columns = append(row.Columns, SqliteColumn{Name: "__name__", Value: sample.Metric})
+		for _, label := range sample.Labels {
+			row.Columns = append(row.Columns, SqliteColumn{Name: label.LabelName, Value: label.LabelValue})
+		}
+		row.Columns = append(row.Columns,
+			SqliteColumn{Name: "value", Value: strconv.FormatFloat(sample.Value, 'g', -1, 64)},
+			SqliteColumn{Name: "timestamp", Value: strconv.FormatInt(sample.Timestamp, 10)},
+		)
+		result.Rows = append(result.Rows, row)
+	}
+	result.Success = true
 	return result
 }
 
-func insertSample(db *sql.DB, sample *api.Sample) error {
+// encodeValue returns the value and the bits column for a sample value, SQLite
+// turns NaN into NULL so its bits are stored instead to preserve the payload
+func encodeValue(value float64) (interface{}, interface{}) {
+	if math.IsNaN(value) {
+		return nil, int64(math.Float64bits(value))
+	}
+	return value, nil
+}
+
+func decodeValue(value sql.NullFloat64, bits sql.NullInt64) float64 {
+	if value.Valid {
+		return value.Float64
+	}
+	return math.Float64frombits(uint64(bits.Int64))
+}
+
+// preparer is implemented by sql.DB and sql.Tx
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+func insertSample(db preparer, sample *api.Sample) error {
 	hash := getTimeseries(sample.Labels)
 	stmt, err := db.Prepare(`insert into timeseries(hash) values(?) on conflict(hash) do update set hash = hash returning id;`)
 	if err != nil {
@@ -132,19 +356,24 @@ insert into labels(name) values(?) on conflict(name) do update set name = name r
 	}
 
 	stmt, err = db.Prepare(`
-insert or ignore into samples(timestamp, timeseries_id, value) values(?, ?, ?)
+insert or ignore into samples(timestamp, timeseries_id, value, value_bits) values(?, ?, ?, ?)
 `)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec(time.Now().Unix(), timeseriesId, sample.Value)
+	timestamp := time.Now().UnixMilli()
+	if sample.Timestamp != nil {
+		timestamp = *sample.Timestamp
+	}
+	value, bits := encodeValue(sample.Value)
+	result, err := stmt.Exec(timestamp, timeseriesId, value, bits)
 	if err != nil {
 		return err
 	}
 
 	// no new metric was inserted, exit early
-	// we can only capture metrics at 1s resolution
+	// samples are captured at 1ms resolution
 	metricId, err := result.LastInsertId()
 	if err != nil {
 		return err
@@ -170,17 +399,66 @@ insert into timeseries_labels(timeseries_id, label_id, label_value) values(?,?,?
 	return nil
 }
 
+func insertMetadata(db preparer, metadata *api.Metadata) error {
+	stmt, err := db.Prepare(`
+insert into metadata(name, type, help, unit) values(?, ?, ?, ?) on conflict(name) do update set type = excluded.type, help = excluded.help, unit = excluded.unit
+`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(metadata.Name, string(metadata.Type), metadata.Help, metadata.Unit)
+	return err
+}
+
+// insertFamily stores the metadata of the family along with the series of its
+// histograms and summaries
+func insertFamily(db preparer, family *api.Family) error {
+	err := insertMetadata(db, &family.Metadata)
+	if err != nil {
+		return err
+	}
+
+	var samples []api.Sample
+	for _, h := range family.Histograms {
+		samples = append(samples, h.Samples(family.Name)...)
+	}
+	for _, s := range family.Summaries {
+		samples = append(samples, s.Samples(family.Name)...)
+	}
+
+	for _, sample := range samples {
+		err = insertSample(db, &sample)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func NewSqliteStore(filename string, wg *sync.WaitGroup) (*SqliteStore, error) {
 	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v?cache=shared&mode=rwc&_journal_mode=WAL", filename))
 	if err != nil {
 		return nil, err
 	}
 
+	exists, err := tableExists(db, "samples")
+	if err != nil {
+		return nil, err
+	}
+
 	err = createTables(db)
 	if err != nil {
 		return nil, err
 	}
 
+	err = migrate(db, !exists)
+	if err != nil {
+		return nil, err
+	}
+
 	wg.Add(1)
 	return &SqliteStore{
 		db: db,
@@ -188,22 +466,91 @@ func NewSqliteStore(filename string, wg *sync.WaitGroup) (*SqliteStore, error) {
 	}, nil
 }
 
-func (s *SqliteStore) Run(samples <-chan api.Sample, quit <-chan bool, queries <-chan promql.PromQlASTElement) {
+func (s *SqliteStore) addSample(sample *api.Sample) {
+	err := insertSample(s.db, sample)
+	if err != nil {
+		log.Printf("[sqlite] error adding sample: %v", err)
+	}
+}
+
+// writeBatch writes the samples and families of a scrape in one transaction,
+// which is rolled back if the scrape failed or any of them could not be written
+func (s *SqliteStore) writeBatch(batch *api.Batch) {
+	defer close(batch.Done)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("[sqlite] error starting transaction: %v", err)
+	}
+	failed := err != nil
+	for {
+		select {
+		case sample := <-batch.Samples:
+			if failed {
+				continue
+			}
+			err = insertSample(tx, &sample)
+			if err != nil {
+				log.Printf("[sqlite] error adding sample: %v", err)
+				failed = true
+			}
+		case family := <-batch.Families:
+			if failed {
+				continue
+			}
+			err = insertFamily(tx, &family)
+			if err != nil {
+				log.Printf("[sqlite] error adding family %v: %v", family.Name, err)
+				failed = true
+			}
+		case commit := <-batch.Commit:
+			if tx == nil {
+				return
+			}
+			if !commit || failed {
+				tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+			if err != nil {
+				log.Printf("[sqlite] error committing transaction: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// drain writes the samples that were sent before the quit signal, batches are
+// written as a whole when they are received
+func (s *SqliteStore) drain(samples <-chan api.Sample) {
+	for {
+		select {
+		case sample := <-samples:
+			s.addSample(&sample)
+		default:
+			return
+		}
+	}
+}
+
+// Run writes samples and the batches of scrapes and answers queries until quit
+// receives a value, the scrapers have to be stopped before
+func (s *SqliteStore) Run(samples <-chan api.Sample, batches <-chan *api.Batch, quit <-chan bool, queries <-chan SqliteQuery) {
 	go func() {
 		for true {
 			select {
 			case <-quit:
 				log.Print("[sqlite] quit signal received")
+				s.drain(samples)
 				s.db.Close()
 				s.wg.Done()
-				break
+				return
 			case sample := <-samples:
-				err := insertSample(s.db, &sample)
-				if err != nil {
-					log.Printf("[sqlite] error adding sample: %v", err)
-				}
+				s.addSample(&sample)
+			case batch := <-batches:
+				s.writeBatch(batch)
 			case query := <-queries:
-				_ = runQuery(s.db, query)
+				query.Result <- runQuery(s.db, query.Query)
 			}
 		}
 	}()
@@ -0,0 +1,583 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"scrape/api"
+	"scrape/pkg/promql"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SqliteMigrateTimestamps(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+
+	// a database as written by versions that stored seconds
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v?mode=rwc", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`create table samples (timestamp INTEGER, timeseries_id INTEGER, value REAL, UNIQUE(timestamp, timeseries_id))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into samples(timestamp, timeseries_id, value) values(1697000000, 1, 1.0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	var timestamp int64
+	err = sqlite.db.QueryRow(`select timestamp from samples where timeseries_id = 1`).Scan(&timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp != 1697000000000 {
+		t.Fatalf("unexpected timestamp, wanted %v, got %v", 1697000000000, timestamp)
+	}
+
+	var version int
+	err = sqlite.db.QueryRow(`pragma user_version`).Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("unexpected schema version, wanted %v, got %v", len(migrations), version)
+	}
+}
+
+func Test_SqliteTimeseriesHash(t *testing.T) {
+	type testcase struct {
+		a     []api.Label
+		b     []api.Label
+		equal bool
+	}
+
+	testcases := []testcase{
+		{
+			a:     []api.Label{{Name: "__name__", Value: "m"}, {Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+			b:     []api.Label{{Name: "b", Value: "2"}, {Name: "__name__", Value: "m"}, {Name: "a", Value: "1"}},
+			equal: true,
+		},
+		{
+			a:     []api.Label{{Name: "ab", Value: "c"}},
+			b:     []api.Label{{Name: "a", Value: "bc"}},
+			equal: false,
+		},
+		{
+			a:     []api.Label{{Name: "a", Value: "b"}, {Name: "c", Value: "d"}},
+			b:     []api.Label{{Name: "a", Value: "bc"}, {Name: "", Value: "d"}},
+			equal: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		if (getTimeseries(tc.a) == getTimeseries(tc.b)) != tc.equal {
+			t.Fatalf("unexpected hashes of %v and %v, wanted equal %v", tc.a, tc.b, tc.equal)
+		}
+	}
+}
+
+func Test_SqliteMigrateHashes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two series with the same labels in a different order, as stored by
+	// versions that hashed the labels in order
+	for _, query := range []string{
+		`insert into timeseries(id, hash) values(1, 'old-1'), (2, 'old-2'), (3, 'old-3')`,
+		`insert into labels(id, name) values(1, '__name__'), (2, 'a'), (3, 'b')`,
+		`insert into timeseries_labels(timeseries_id, label_id, label_value) values
+			(1, 1, 'm'), (1, 2, '1'), (1, 3, '2'),
+			(2, 3, '2'), (2, 1, 'm'), (2, 2, '1'),
+			(3, 1, 'other')`,
+		`insert into samples(timestamp, timeseries_id, value) values(1000, 1, 1), (1000, 2, 2), (2000, 2, 3), (1000, 3, 4)`,
+		`pragma user_version = 2`,
+	} {
+		_, err = sqlite.db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sqlite.db.Close()
+
+	sqlite, err = NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	type testcase struct {
+		labels         []api.Label
+		wantTimestamps []int64
+	}
+
+	testcases := []testcase{
+		{
+			labels:         []api.Label{{Name: "__name__", Value: "m"}, {Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+			wantTimestamps: []int64{1000, 2000},
+		},
+		{
+			labels:         []api.Label{{Name: "__name__", Value: "other"}},
+			wantTimestamps: []int64{1000},
+		},
+	}
+
+	for _, tc := range testcases {
+		rows, err := sqlite.db.Query(`
+select s.timestamp from samples s join timeseries t on t.id = s.timeseries_id
+where t.hash = ? order by s.timestamp`, getTimeseries(tc.labels))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var timestamps []int64
+		for rows.Next() {
+			var timestamp int64
+			err = rows.Scan(&timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			timestamps = append(timestamps, timestamp)
+		}
+		rows.Close()
+		if fmt.Sprint(timestamps) != fmt.Sprint(tc.wantTimestamps) {
+			t.Fatalf("unexpected samples of %v, wanted %v, got %v", tc.labels, tc.wantTimestamps, timestamps)
+		}
+	}
+
+	var count int
+	err = sqlite.db.QueryRow(`select count(*) from timeseries`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("unexpected number of series, wanted 2, got %v", count)
+	}
+}
+
+func Test_SqliteMillisecondSamples(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	labels := []api.Label{{Name: "__name__", Value: "metric"}}
+	for i := int64(0); i < 3; i++ {
+		err = insertSample(sqlite.db, &api.Sample{
+			Labels:    labels,
+			Value:     float64(i),
+			Timestamp: api.Timestamp(1697000000000 + i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	err = sqlite.db.QueryRow(`select count(*) from samples`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("unexpected number of samples, wanted 3, got %v", count)
+	}
+}
+
+func Test_SqliteSampleTimestamp(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	type testcase struct {
+		name      string
+		timestamp *int64
+		// wantNow expects the time of the insert for samples without a
+		// timestamp
+		wantNow       bool
+		wantTimestamp int64
+	}
+
+	testcases := []testcase{
+		{name: "explicit", timestamp: api.Timestamp(1697000000000), wantTimestamp: 1697000000000},
+		{name: "epoch", timestamp: api.Timestamp(0), wantTimestamp: 0},
+		{name: "missing", wantNow: true},
+	}
+
+	for _, tc := range testcases {
+		before := time.Now().UnixMilli()
+		labels := []api.Label{{Name: "__name__", Value: tc.name}}
+		err = insertSample(sqlite.db, &api.Sample{Labels: labels, Value: 1, Timestamp: tc.timestamp})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var timestamp int64
+		err = sqlite.db.QueryRow(`select timestamp from samples s join timeseries t on t.id = s.timeseries_id where t.hash = ?`, getTimeseries(labels)).Scan(&timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantNow {
+			if timestamp < before || timestamp > time.Now().UnixMilli() {
+				t.Fatalf("%v: unexpected timestamp %v, wanted the time of the insert", tc.name, timestamp)
+			}
+			continue
+		}
+		if timestamp != tc.wantTimestamp {
+			t.Fatalf("%v: unexpected timestamp, wanted %v, got %v", tc.name, tc.wantTimestamp, timestamp)
+		}
+	}
+}
+
+func Test_SqliteInsertFamily(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	family := &api.Family{
+		Metadata: api.Metadata{
+			Name: "latency",
+			Type: api.MetricTypeHistogram,
+			Help: "Request latency.",
+			Unit: "seconds",
+		},
+		Histograms: []api.Histogram{
+			{
+				Labels: []api.Label{{Name: "__name__", Value: "latency"}},
+				Buckets: []api.Bucket{
+					{UpperBound: 0.5, Count: 1},
+					{UpperBound: math.Inf(1), Count: 2},
+				},
+				Sum:       1.5,
+				Count:     2,
+				Timestamp: api.Timestamp(1697000000000),
+			},
+		},
+	}
+
+	err = insertFamily(sqlite.db, family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = sqlite.db.QueryRow(`select count(*) from samples`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("unexpected number of samples, wanted 4, got %v", count)
+	}
+
+	var metricType, unit string
+	err = sqlite.db.QueryRow(`select type, unit from metadata where name = 'latency'`).Scan(&metricType, &unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metricType != string(api.MetricTypeHistogram) {
+		t.Fatalf("unexpected type, wanted %v, got %v", api.MetricTypeHistogram, metricType)
+	}
+	if unit != "seconds" {
+		t.Fatalf("unexpected unit, wanted seconds, got %v", unit)
+	}
+}
+
+func Test_SqliteMigrateMetadataUnit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+
+	// a database as written by versions that did not store units
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v?mode=rwc", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`create table samples (timestamp INTEGER, timeseries_id INTEGER, value REAL, value_bits INTEGER, UNIQUE(timestamp, timeseries_id))`,
+		`create table metadata (name TEXT PRIMARY KEY, type TEXT, help TEXT)`,
+		`insert into metadata(name, type, help) values('latency', 'histogram', 'Request latency.')`,
+		`pragma user_version = 3`,
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	err = insertMetadata(sqlite.db, &api.Metadata{
+		Name: "latency",
+		Type: api.MetricTypeHistogram,
+		Help: "Request latency.",
+		Unit: "seconds",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unit string
+	err = sqlite.db.QueryRow(`select unit from metadata where name = 'latency'`).Scan(&unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit != "seconds" {
+		t.Fatalf("unexpected unit, wanted seconds, got %v", unit)
+	}
+}
+
+func Test_SqliteSpecialValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	// a NaN with a payload, as used for staleness markers
+	payloadNaN := math.Float64frombits(0x7ff0000000000002)
+	values := []float64{math.NaN(), payloadNaN, math.Inf(1), math.Inf(-1), -0.5}
+	labels := []api.Label{{Name: "__name__", Value: "metric"}}
+	for i, value := range values {
+		err = insertSample(sqlite.db, &api.Sample{
+			Labels:    labels,
+			Value:     value,
+			Timestamp: api.Timestamp(int64(i + 1)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := sqlite.db.Query(`select value, value_bits from samples order by timestamp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	i := 0
+	for rows.Next() {
+		var value sql.NullFloat64
+		var bits sql.NullInt64
+		err = rows.Scan(&value, &bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeValue(value, bits)
+		if math.Float64bits(got) != math.Float64bits(values[i]) {
+			t.Fatalf("unexpected value, wanted %x, got %x", math.Float64bits(values[i]), math.Float64bits(got))
+		}
+		i++
+	}
+	if i != len(values) {
+		t.Fatalf("unexpected number of samples, wanted %v, got %v", len(values), i)
+	}
+}
+
+func Test_SqliteQueryStaleness(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+
+	now := time.Now()
+	ago := func(d time.Duration) int64 {
+		return now.Add(-d).UnixMilli()
+	}
+	write := func(instance string, value float64, timestamp int64) {
+		err := insertSample(sqlite.db, &api.Sample{
+			Labels:    []api.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: instance}},
+			Value:     value,
+			Timestamp: api.Timestamp(timestamp),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("fresh", 1, ago(time.Minute))
+	write("fresh", 0, ago(2*time.Minute))
+	// marked stale after the target went away
+	write("stale", 1, ago(2*time.Minute))
+	write("stale", api.StaleNaN, ago(time.Minute))
+	// the latest sample is older than the lookback delta
+	write("old", 1, ago(10*time.Minute))
+	// back after being marked stale
+	write("back", 1, ago(3*time.Minute))
+	write("back", api.StaleNaN, ago(2*time.Minute))
+	write("back", 1, ago(time.Minute))
+
+	type testcase struct {
+		query         *promql.PromQlTimeseries
+		wantInstances []string
+		wantValues    []float64
+	}
+
+	testcases := []testcase{
+		{
+			query:         &promql.PromQlTimeseries{Name: "up"},
+			wantInstances: []string{"fresh", "back"},
+			wantValues:    []float64{1, 1},
+		},
+		{
+			// range queries skip the markers
+			query:         &promql.PromQlTimeseries{Name: "up", Duration: 5 * time.Minute},
+			wantInstances: []string{"fresh", "fresh", "stale", "back", "back"},
+			wantValues:    []float64{0, 1, 1, 1, 1},
+		},
+		{
+			query: &promql.PromQlTimeseries{Name: "missing"},
+		},
+	}
+
+	for _, tc := range testcases {
+		result, err := tc.query.Eval(sqlite.db, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result) != len(tc.wantInstances) {
+			t.Fatalf("unexpected result for %v, wanted %v, got %v", tc.query.Name, tc.wantInstances, result)
+		}
+		for i, sample := range result {
+			if sample.Metric != tc.query.Name || len(sample.Labels) != 1 {
+				t.Fatalf("unexpected series %v", sample)
+			}
+			if sample.Labels[0].LabelValue != tc.wantInstances[i] || sample.Value != tc.wantValues[i] {
+				t.Fatalf("unexpected sample %v, wanted %v %v", sample, tc.wantInstances[i], tc.wantValues[i])
+			}
+		}
+	}
+}
+
+func Test_SqliteRunQuit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(chan api.Sample, 16)
+	quit := make(chan bool, 1)
+	labels := []api.Label{{Name: "__name__", Value: "metric"}}
+	for i := int64(0); i < 10; i++ {
+		samples <- api.Sample{Labels: labels, Value: float64(i), Timestamp: api.Timestamp(1697000000000 + i)}
+	}
+	quit <- true
+
+	// the samples sent before the quit signal are written before the store
+	// stops
+	sqlite.Run(samples, make(chan *api.Batch), quit, make(chan SqliteQuery))
+	wg.Wait()
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v?mode=ro", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	err = db.QueryRow(`select count(*) from samples`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("unexpected number of samples, wanted 10, got %v", count)
+	}
+}
+
+func Test_SqliteRunBatch(t *testing.T) {
+	type testcase struct {
+		metric    string
+		commit    bool
+		wantCount int
+	}
+
+	testcases := []testcase{
+		{metric: "committed", commit: true, wantCount: 3},
+		{metric: "rolled_back", commit: false, wantCount: 0},
+	}
+
+	filename := filepath.Join(t.TempDir(), "metrics.db")
+	wg := &sync.WaitGroup{}
+	sqlite, err := NewSqliteStore(filename, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := make(chan *api.Batch)
+	quit := make(chan bool)
+	sqlite.Run(make(chan api.Sample), batches, quit, make(chan SqliteQuery))
+
+	for _, tc := range testcases {
+		batch := api.NewBatch()
+		batches <- batch
+		batch.Samples <- api.Sample{
+			Labels:    []api.Label{{Name: "__name__", Value: tc.metric}},
+			Value:     1,
+			Timestamp: api.Timestamp(1697000000000),
+		}
+		batch.Families <- api.Family{
+			Metadata: api.Metadata{Name: tc.metric + "_latency", Type: api.MetricTypeSummary},
+			Summaries: []api.Summary{
+				{
+					Labels:    []api.Label{{Name: "__name__", Value: tc.metric + "_latency"}},
+					Sum:       1,
+					Count:     2,
+					Timestamp: api.Timestamp(1697000000000),
+				},
+			},
+		}
+		batch.Commit <- tc.commit
+		<-batch.Done
+	}
+	quit <- true
+	wg.Wait()
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v?mode=ro", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tc := range testcases {
+		var count int
+		err = db.QueryRow(`select count(distinct tl.timeseries_id) from timeseries_labels tl join labels l on l.id = tl.label_id where l.name = '__name__' and tl.label_value like ?`, tc.metric+"%").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.wantCount {
+			t.Fatalf("%v: unexpected number of series, wanted %v, got %v", tc.metric, tc.wantCount, count)
+		}
+	}
+}